@@ -0,0 +1,280 @@
+package bufpipe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrSlowSubscriber = fmt.Errorf("subscriber is too slow") // A subscriber is disconnected by SlowDisconnect policy
+
+// Policy on a slow subscriber of a bounded Broadcast, whose unread data exceeds the limit.
+type SlowPolicy int
+
+const (
+	SlowDrop       SlowPolicy = iota // The oldest unread data of the subscriber is dropped.
+	SlowDisconnect                   // The subscriber is disconnected, and its read functions return ErrSlowSubscriber.
+)
+
+func (p SlowPolicy) String() string {
+	switch p {
+	case SlowDrop:
+		return "SlowDrop"
+	case SlowDisconnect:
+		return "SlowDisconnect"
+	}
+	return fmt.Sprintf("SlowPolicy(%d)", int(p))
+}
+
+// Broadcast is a pipe that delivers every data to all of its subscribers.
+// A subscriber receives the data appended after it is subscribed, in order.
+// The data are stored once and shared by the subscribers, and released when all subscribers have read them.
+// When closed, the read functions of the subscribers return io.EOF, or the error given to CloseWithError(), after the remaining data.
+type Broadcast[T any] struct {
+	limit  uint64 // max number of unread data of a subscriber; 0 for unlimited
+	policy SlowPolicy
+
+	mu       sync.Mutex
+	tail     *bcNode[T] // empty node to be filled by the next Append()
+	seq      uint64     // number of appended data
+	subs     map[*Subscriber[T]]struct{}
+	closed   bool
+	closeErr error         // error for the readers set by CloseWithError()
+	notify   chan struct{} // closed and replaced when a data is appended or the state is changed
+	waiting  bool          // set if notify is being waited
+}
+
+// a node of the list of broadcasted data
+type bcNode[T any] struct {
+	v    T
+	next *bcNode[T] // nil for the tail node
+}
+
+// A reader of a Broadcast, made by Broadcast.Subscribe().
+type Subscriber[T any] struct {
+	b       *Broadcast[T]
+	cur     *bcNode[T] // next node to read; guarded by b.mu
+	seq     uint64     // number of data read or dropped, counted in the sequence of the Broadcast
+	dropped uint64     // number of data dropped by SlowDrop policy
+	err     error      // set when unsubscribed or disconnected
+}
+
+// Make a new broadcast of type T with no limit on the subscribers.
+func NewBroadcast[T any]() *Broadcast[T] {
+	return &Broadcast[T]{
+		tail:   &bcNode[T]{},
+		subs:   make(map[*Subscriber[T]]struct{}),
+		notify: make(chan struct{}),
+	}
+}
+
+// Make a new broadcast of type T that holds at most limit unread data for each subscriber.
+// A subscriber that has limit unread data is handled by the policy on Append().
+// If limit <= 0, then the broadcast is unlimited as NewBroadcast().
+func NewBoundedBroadcast[T any](limit int, policy SlowPolicy) *Broadcast[T] {
+	b := NewBroadcast[T]()
+	if limit > 0 {
+		b.limit = uint64(limit)
+	}
+	b.policy = policy
+	return b
+}
+
+// Number of the subscribers.
+func (b *Broadcast[T]) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// Add a new subscriber, which receives the data appended after the call.
+// If the broadcast is already closed, the subscriber reads io.EOF or the error given to CloseWithError().
+func (b *Broadcast[T]) Subscribe() *Subscriber[T] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &Subscriber[T]{b: b, cur: b.tail, seq: b.seq}
+	if !b.closed {
+		b.subs[s] = struct{}{}
+	}
+	return s
+}
+
+// Append a data to all subscribers.
+// n is the number of subscribers the data is delivered to.
+// Slow subscribers of a bounded broadcast are handled by the policy.
+// If the broadcast is closed, an io.ErrClosedPipe is returned.
+func (b *Broadcast[T]) Append(v T) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		err = io.ErrClosedPipe
+		return
+	}
+	t := b.tail
+	t.v = v
+	t.next = &bcNode[T]{}
+	b.tail = t.next
+	b.seq++
+
+	if b.limit > 0 {
+		for s := range b.subs {
+			if b.seq-s.seq <= b.limit {
+				continue
+			}
+			switch b.policy {
+			case SlowDisconnect:
+				b.detach(s, ErrSlowSubscriber)
+			default: // SlowDrop
+				s.cur = s.cur.next
+				s.seq++
+				s.dropped++
+			}
+		}
+	}
+	n = len(b.subs)
+	b.wake()
+	return
+}
+
+// Close the broadcast.
+// After the Close(), Append() will fail but the subscribers can read the remaining data.
+// Returns false if the broadcast is already closed.
+func (b *Broadcast[T]) Close() bool {
+	return b.CloseWithError(nil)
+}
+
+// Close the broadcast with an error.
+// After the remaining data are read, the read functions of the subscribers return err instead of io.EOF.
+// If err is nil, then the function works as Close().
+// Returns false if the broadcast is already closed.
+func (b *Broadcast[T]) CloseWithError(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.closed, b.closeErr = true, err
+	b.wake()
+	return true
+}
+
+// remove a subscriber with an error for its readers; the lock must be held
+func (b *Broadcast[T]) detach(s *Subscriber[T], err error) {
+	delete(b.subs, s)
+	s.cur = nil // release the unread data
+	s.err = err
+}
+
+// wake the goroutines waiting for a change; the lock must be held
+func (b *Broadcast[T]) wake() {
+	if b.waiting {
+		close(b.notify)
+		b.notify = make(chan struct{})
+		b.waiting = false
+	}
+}
+
+// Number of unread data of the subscriber.
+func (s *Subscriber[T]) Len() int {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.err != nil {
+		return 0
+	}
+	return int(s.b.seq - s.seq)
+}
+
+// Number of data dropped by SlowDrop policy.
+func (s *Subscriber[T]) Dropped() uint64 {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	return s.dropped
+}
+
+// Remove the subscriber from the broadcast. The unread data are discarded.
+// After the Unsubscribe(), Fetch() and Receive() return io.ErrClosedPipe.
+// Blocking Receive() calls are released.
+func (s *Subscriber[T]) Unsubscribe() {
+	b := s.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.err == nil {
+		b.detach(s, io.ErrClosedPipe)
+		b.wake()
+	}
+}
+
+// Get a data from the subscriber.
+// if there is no data and the broadcast is NOT closed, then returns ErrNoData.
+// if there is no data and the broadcast is closed, then returns io.EOF, or the error given to CloseWithError().
+func (s *Subscriber[T]) Fetch() (v T, err error) {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	return s.fetch()
+}
+
+// fetch a data; the lock must be held
+func (s *Subscriber[T]) fetch() (v T, err error) {
+	if s.err != nil {
+		err = s.err
+		return
+	}
+	if s.cur.next != nil {
+		v = s.cur.v
+		s.cur = s.cur.next
+		s.seq++
+		return
+	}
+	if s.b.closed {
+		err = io.EOF
+		if s.b.closeErr != nil {
+			err = s.b.closeErr
+		}
+		return
+	}
+	err = ErrNoData
+	return
+}
+
+// Receive a data from the subscriber.
+// This function blocks until a new data is received, the broadcast is closed, the subscriber is removed, or the ctx.Done() is done.
+// Returns io.EOF, or the error given to CloseWithError(), if the broadcast is closed and no data left.
+func (s *Subscriber[T]) Receive(ctx context.Context) (v T, err error) {
+	b := s.b
+	for {
+		b.mu.Lock()
+		v, err = s.fetch()
+		if err != ErrNoData {
+			b.mu.Unlock()
+			return
+		}
+		b.waiting = true
+		ch := b.notify
+		b.mu.Unlock()
+
+		select {
+		case <-ch: // a data is appended, or the state is changed
+		case <-ctx.Done():
+			err = ctx.Err()
+			if err == nil {
+				err = context.Canceled
+			}
+			return
+		}
+	}
+}
+
+// Receive a data from the subscriber, waiting at most for the duration d.
+// Returns os.ErrDeadlineExceeded if no data is received in time.
+func (s *Subscriber[T]) ReceiveTimeout(d time.Duration) (v T, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	v, err = s.Receive(ctx)
+	if err == context.DeadlineExceeded {
+		err = os.ErrDeadlineExceeded
+	}
+	return
+}
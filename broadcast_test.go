@@ -0,0 +1,148 @@
+package bufpipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	b := NewBroadcast[int]()
+	b.Append(-1) // no subscriber
+
+	const subs, count = 4, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < subs; i++ {
+		s := b.Subscribe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				v, err := s.Receive(context.Background())
+				if err == io.EOF {
+					if i != count {
+						t.Errorf("unexpected number of data: %d", i)
+					}
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if v != i {
+					t.Errorf("unexpected data; expected %d, actual %d", i, v)
+					return
+				}
+			}
+		}()
+	}
+	if b.Subscribers() != subs {
+		t.Errorf("unexpected number of subscribers: %d", b.Subscribers())
+	}
+	for i := 0; i < count; i++ {
+		if n, err := b.Append(i); n != subs || err != nil {
+			t.Fatalf("unexpected append result: %d, %v", n, err)
+		}
+	}
+	b.Close()
+	wg.Wait()
+
+	if _, err := b.Append(0); err != io.ErrClosedPipe {
+		t.Errorf("Append on a closed broadcast must return io.ErrClosedPipe, actual %v", err)
+	}
+	if _, err := b.Subscribe().Fetch(); err != io.EOF {
+		t.Errorf("a subscriber of a closed broadcast must read io.EOF, actual %v", err)
+	}
+
+	// a late subscriber receives only the data appended after the subscription
+	b = NewBroadcast[int]()
+	s1 := b.Subscribe()
+	b.Append(1)
+	s2 := b.Subscribe()
+	b.Append(2)
+	errTest := errors.New("test")
+	b.CloseWithError(errTest)
+	if s1.Len() != 2 || s2.Len() != 1 {
+		t.Errorf("unexpected unread data: %d, %d", s1.Len(), s2.Len())
+	}
+	for _, want := range []int{1, 2} {
+		if v, err := s1.Fetch(); v != want || err != nil {
+			t.Errorf("unexpected fetch result: %d, %v", v, err)
+		}
+	}
+	if v, err := s2.Fetch(); v != 2 || err != nil {
+		t.Errorf("unexpected fetch result: %d, %v", v, err)
+	}
+	if _, err := s2.Fetch(); err != errTest {
+		t.Errorf("Fetch must return the error given to CloseWithError, actual %v", err)
+	}
+}
+
+func TestBroadcastUnsubscribe(t *testing.T) {
+	b := NewBroadcast[int]()
+	s1, s2 := b.Subscribe(), b.Subscribe()
+
+	done := make(chan error)
+	go func() {
+		_, err := s1.Receive(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s1.Unsubscribe()
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Errorf("Unsubscribe must release a blocked Receive with io.ErrClosedPipe, actual %v", err)
+	}
+	if n, _ := b.Append(1); n != 1 {
+		t.Errorf("unexpected number of subscribers: %d", n)
+	}
+	if v, err := s2.Fetch(); v != 1 || err != nil {
+		t.Errorf("unexpected fetch result: %d, %v", v, err)
+	}
+	if _, err := s2.Fetch(); err != ErrNoData {
+		t.Errorf("Fetch on an empty subscriber must return ErrNoData, actual %v", err)
+	}
+	if _, err := s2.ReceiveTimeout(10 * time.Millisecond); err != os.ErrDeadlineExceeded {
+		t.Errorf("ReceiveTimeout must return os.ErrDeadlineExceeded, actual %v", err)
+	}
+}
+
+func TestBoundedBroadcast(t *testing.T) {
+	// a slow subscriber drops the oldest data
+	b := NewBoundedBroadcast[int](3, SlowDrop)
+	slow, fast := b.Subscribe(), b.Subscribe()
+	for i := 0; i < 10; i++ {
+		b.Append(i)
+		if v, err := fast.Fetch(); v != i || err != nil {
+			t.Fatalf("unexpected fetch result: %d, %v", v, err)
+		}
+	}
+	if slow.Len() != 3 || slow.Dropped() != 7 {
+		t.Errorf("unexpected slow subscriber state: %d, %d", slow.Len(), slow.Dropped())
+	}
+	for _, want := range []int{7, 8, 9} {
+		if v, err := slow.Fetch(); v != want || err != nil {
+			t.Errorf("unexpected fetch result: %d, %v", v, err)
+		}
+	}
+
+	// a slow subscriber is disconnected
+	b = NewBoundedBroadcast[int](3, SlowDisconnect)
+	slow, fast = b.Subscribe(), b.Subscribe()
+	for i := 0; i < 4; i++ {
+		b.Append(i)
+		fast.Fetch()
+	}
+	if b.Subscribers() != 1 {
+		t.Errorf("unexpected number of subscribers: %d", b.Subscribers())
+	}
+	if _, err := slow.Fetch(); err != ErrSlowSubscriber {
+		t.Errorf("a disconnected subscriber must return ErrSlowSubscriber, actual %v", err)
+	}
+	if _, err := fast.Fetch(); err != ErrNoData {
+		t.Errorf("unexpected fetch result: %v", err)
+	}
+}
@@ -2,53 +2,130 @@ package bufpipe
 
 import (
 	"context"
+	"errors"
 	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // A Pipe of []Byte with io.Reader, io.WriteCloser and io.ReadFrom interface.
 type BytePipe struct {
 	Pipe[[]byte] // Pipe of []byte data block
 
-	ReadFromSize int // size of []byte data blocks created by ReadFrom()
-	activeBuf    []byte
+	ReadFromSize     int  // size of []byte data blocks created by ReadFrom(); the max size if AdaptiveReadFrom is set
+	StreamReadFrom   bool // if true, ReadFrom() appends the data as soon as it is read, not waiting to fill a whole block
+	AdaptiveReadFrom bool // if true, ReadFrom() starts with small blocks and adjusts the block size to the observed read sizes
+	CoalesceSize     int  // if > 0, Write() merges small writes into a block of up to CoalesceSize bytes
+	UsePool          bool // if true, the data blocks created by Write() and ReadFrom() are allocated from a shared pool, and put back when consumed; see Release()
+	MaxBufferedBytes int  // if > 0, writing over MaxBufferedBytes of Buffered() works as the Overflow policy; Block by default
+	MaxSliceSize     int  // max size of the data returned by ReadSlice() and ReadLine(); 0 for unlimited
+	activeBuf        []byte
+	activeBlock      []byte        // the whole block of activeBuf, to be released when consumed
+	rsem             chan struct{} // read lock guarding activeBuf and the fields below; buffered by 1
+
+	sliceBuf     []byte            // buffer for ReadSlice() crossing the data blocks
+	lastByte     int               // last byte read, for UnreadByte(); -1 means invalid
+	lastRuneSize int               // size of the last rune read by ReadRune(), for UnreadRune(); -1 means invalid
+	lastRune     [utf8.UTFMax]byte // the last rune read by ReadRune()
+
+	wmu     sync.Mutex // serializes coalescing Write()
+	mu      sync.Mutex // guards openBuf
+	openBuf []byte     // the open block of coalescing Write(), not yet in the queue
+	openLen int64      // len(openBuf); read without the lock for the fast path
+
+	pmu    sync.Mutex         // guards pooled
+	pooled map[*byte]struct{} // blocks allocated from the pool by alloc(), and not handed over to a consumer
+
+	buffered     int64              // number of unread bytes, including the bytes reserved by running writes
+	bytesWritten uint64             // number of bytes written
+	bytesRead    uint64             // number of bytes read
+	space        waitList[struct{}] // goroutines waiting for the buffered bytes to go under MaxBufferedBytes
 }
 
 var (
 	ReadFromBufSize = 1 * 1024 * 1024 // default size for BytePipe.ReadFromSize
 )
 
+// min size of the remaining buffer to be reused for the next read in streaming ReadFrom()
+const minStreamReadSize = 512
+
+// initial and min block size of adaptive ReadFrom()
+const minAdaptiveReadSize = 4 * 1024
+
+var errInvalidWrite = errors.New("invalid write result") // io.Writer returned an invalid count
+
 // Create a new BytePipe.
 func NewBytePipe() *BytePipe {
-	return &BytePipe{Pipe: *NewPipe[[]byte](), ReadFromSize: ReadFromBufSize}
+	return newBytePipe(0)
+}
+
+// Create a new BytePipe that holds at most capacity data blocks.
+// Writing to a full BytePipe behaves as the Overflow policy of the pipe.
+func NewBoundedBytePipe(capacity int) *BytePipe {
+	return newBytePipe(capacity)
+}
+
+func newBytePipe(capacity int) *BytePipe {
+	bp := &BytePipe{Pipe: *NewBoundedPipe[[]byte](capacity), ReadFromSize: ReadFromBufSize}
+	bp.fill, bp.fillable = bp.fillOpen, bp.hasOpen
+	bp.dropHook = func(p []byte) {
+		// the block is handed over to OnDrop()
+		bp.disown(p)
+		bp.freeBytes(len(p))
+	}
+	bp.lastByte, bp.lastRuneSize = -1, -1
+	bp.rsem = make(chan struct{}, 1)
+	return bp
 }
 
 // io.Reader inteface for BytePipe.
 // The data is internally copied from the Pipe to the provided buffer.
 // Use Fetch() or Receive() for zero-copy data receiving.
+//
+// Read() and the other read functions of BytePipe are safe for concurrent use.
+// Each byte is read by exactly one reader, and a Read() gets a contiguous part of the stream.
 func (bp *BytePipe) Read(p []byte) (n int, err error) {
+	return bp.ReadContext(context.Background(), p)
+}
+
+// Read with a context.
+// The function blocks until some data is available, the pipe is closed, the read deadline is exceeded, or the ctx.Done() is done.
+func (bp *BytePipe) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	if bp.readDeadline.expired() {
+		err = os.ErrDeadlineExceeded
+		return
+	}
+	if err = bp.lockRead(ctx); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	defer func() {
+		if n > 0 {
+			bp.consumeBytes(n)
+		}
+	}()
 
-	if bp.readClosed && len(bp.activeBuf) == 0 {
-		err = io.EOF
+	if len(p) > 0 {
+		// only the last ReadRune() can be unread
+		bp.lastRuneSize = -1
+	}
+	if len(bp.activeBuf) == 0 && bp.drained() {
+		err = bp.eof()
 		return
 	}
 
 	for len(p) > 0 {
 		if len(bp.activeBuf) == 0 {
-			bp.activeBuf, err = bp.Pipe.Fetch()
-			//log.Printf("activeBuf: %d, %v", len(bp.activeBuf), err)
-			if err != ErrNoData && err != io.EOF {
-				return
-			}
-			if n > 0 {
-				// receive buffer has some data
-				err = nil
-				return
-			}
-			if err == io.EOF {
-				return
-			}
-			bp.activeBuf, err = bp.Pipe.Receive(context.Background())
+			// wait for a data only if nothing is read yet
+			err = bp.nextBlock(ctx, n == 0)
 			if err != nil {
+				if n > 0 {
+					// receive buffer has some data; the error will be reported on the next Read()
+					err = nil
+				}
 				return
 			}
 		}
@@ -57,39 +134,293 @@ func (bp *BytePipe) Read(p []byte) (n int, err error) {
 		p = p[sz:]
 		n += sz
 		bp.activeBuf = bp.activeBuf[sz:]
+		if sz > 0 {
+			bp.lastByte, bp.lastRuneSize = int(bp.activeBlock[len(bp.activeBlock)-len(bp.activeBuf)-1]), -1
+		}
+		bp.releaseActive()
 	}
 
 	return
 }
 
+// acquire the read lock.
+// The function blocks until the lock is acquired, the read deadline is exceeded, or the ctx.Done() is done.
+func (bp *BytePipe) lockRead(ctx context.Context) error {
+	select {
+	case bp.rsem <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case bp.rsem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return context.Canceled
+	case <-bp.readDeadline.wait():
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// release the read lock
+func (bp *BytePipe) unlockRead() {
+	<-bp.rsem
+}
+
+// get the next data block to the active buffer, releasing the consumed one.
+// If wait is false, then ErrNoData is returned if no data is available.
+func (bp *BytePipe) nextBlock(ctx context.Context, wait bool) (err error) {
+	bp.releaseActive()
+	p, err := bp.Pipe.Fetch()
+	if err == ErrNoData && wait {
+		p, err = bp.Pipe.Receive(ctx)
+	}
+	if err != nil {
+		return
+	}
+	bp.activeBuf, bp.activeBlock = p, p
+	return
+}
+
+// io.WriterTo interface for BytePipe.
+// Each data block in the pipe, including the partially read one, is written to w without copying.
+// The function blocks until the pipe is closed and drained, and returns nil error on io.EOF.
+func (bp *BytePipe) WriteTo(w io.Writer) (n int64, err error) {
+	return bp.WriteToContext(context.Background(), w)
+}
+
+// WriteTo() with a context.
+// The function returns when the pipe is drained, the read deadline is exceeded, or the ctx.Done() is done.
+// If w does not accept a whole block, then the rest of the block remains in the pipe for later reads.
+func (bp *BytePipe) WriteToContext(ctx context.Context, w io.Writer) (n int64, err error) {
+	if bp.readDeadline.expired() {
+		err = os.ErrDeadlineExceeded
+		return
+	}
+	if err = bp.lockRead(ctx); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	for {
+		if len(bp.activeBuf) == 0 {
+			err = bp.nextBlock(ctx, true)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+		}
+
+		l := len(bp.activeBuf)
+		sz, e := w.Write(bp.activeBuf)
+		if sz < 0 || sz > l {
+			sz = 0
+			if e == nil {
+				e = errInvalidWrite
+			}
+		}
+		n += int64(sz)
+		bp.activeBuf = bp.activeBuf[sz:]
+		bp.lastByte, bp.lastRuneSize = -1, -1
+		bp.releaseActive()
+		bp.consumeBytes(sz)
+		if e != nil {
+			err = e
+			return
+		}
+		if sz != l {
+			err = io.ErrShortWrite
+			return
+		}
+	}
+}
+
 // io.Closer for io.WriteCloser, but not for io.ReadCloser.
 // Closing BytePipe prevents data from writing, but Read()/Fetch()/Receive() are OK until io.EOF reached.
 // Check for returning io.EOF, or EOF() to know the end of the stream.
+// Use CloseRead() to close the read side.
 func (bp *BytePipe) Close() bool {
 	return bp.Pipe.Close()
 }
 
+// Close the BytePipe on the read side.
+// All data remaining in the pipe are discarded, and n is the number of discarded bytes.
+// After the CloseRead(), Write() and ReadFrom() fail with err, or io.ErrClosedPipe if err is nil,
+// and Read() returns io.ErrClosedPipe.
+// Blocked reads are released, but the function waits for a WriteTo() blocked in its writer.
+func (bp *BytePipe) CloseRead(err error) (n int) {
+	bp.Pipe.closeRead(err, func(p []byte) {
+		n += len(p)
+		bp.recycle(p)
+	})
+	bp.mu.Lock()
+	p := bp.takeOpen()
+	bp.mu.Unlock()
+	n += len(p)
+	bp.recycle(p)
+
+	// the reader holding the lock returns soon, since the pipe is closed.
+	// the lock is taken regardless of the read deadline.
+	bp.rsem <- struct{}{}
+	n += len(bp.activeBuf)
+	bp.activeBuf = nil
+	bp.releaseActive()
+	bp.unlockRead()
+
+	bp.freeBytes(n)
+	return
+}
+
+// Give a data block back to the pool of a BytePipe with UsePool set.
+// Consumers using Fetch() or Receive() may release a block when they are done with it,
+// and the block must not be used after the release. Read() and WriteTo() release consumed blocks automatically,
+// but only the blocks allocated by the pipe; a block passed to Append() is never put back to the pool by the pipe.
+// Only the blocks created by Write() and ReadFrom() should be released. The function does nothing if bp.UsePool is not set.
+func (bp *BytePipe) Release(p []byte) {
+	if bp.UsePool {
+		bp.disown(p)
+		putBuf(p[:cap(p)])
+	}
+}
+
+// put a block consumed by the pipe back to the pool, only if it is allocated by alloc()
+func (bp *BytePipe) recycle(p []byte) {
+	if bp.disown(p) {
+		putBuf(p[:cap(p)])
+	}
+}
+
+// release the active block if it is fully consumed
+func (bp *BytePipe) releaseActive() {
+	if len(bp.activeBuf) == 0 && bp.activeBlock != nil {
+		bp.recycle(bp.activeBlock)
+		bp.activeBlock = nil
+	}
+}
+
+// allocate a data block. A pooled block is recorded, so that only the blocks of the pipe are put back to the pool.
+func (bp *BytePipe) alloc(n int) []byte {
+	if !bp.UsePool {
+		return make([]byte, n)
+	}
+	p := getBuf(n)
+	bp.pmu.Lock()
+	if bp.pooled == nil {
+		bp.pooled = make(map[*byte]struct{})
+	}
+	bp.pooled[&p[:1][0]] = struct{}{}
+	bp.pmu.Unlock()
+	return p
+}
+
+// forget a block allocated by alloc(), when it leaves the pipe. Returns false if p is not allocated by alloc().
+func (bp *BytePipe) disown(p []byte) bool {
+	if !bp.UsePool || cap(p) == 0 {
+		return false
+	}
+	k := &p[:1][0]
+	bp.pmu.Lock()
+	defer bp.pmu.Unlock()
+	if _, ok := bp.pooled[k]; !ok {
+		return false
+	}
+	delete(bp.pooled, k)
+	return true
+}
+
 // Check if the BytePipe is closed and no data left for read.
 func (bp *BytePipe) EOF() bool {
-	return bp.readClosed && len(bp.activeBuf) == 0
+	return bp.drained() && bp.Buffered() <= 0
 }
 
 // io.ReaderFrom interface for BytePipe.
 // Incoming data are partitioned into multiple []byte of bp.ReadFromSize and stored.
+// If bp.StreamReadFrom is set, then each data read from r is stored as soon as it arrives,
+// sharing a buffer of bp.ReadFromSize for consecutive small reads.
+// If bp.AdaptiveReadFrom is set, then the blocks start small and grow up to bp.ReadFromSize while the reads fill them,
+// so a small input does not allocate a whole block of bp.ReadFromSize.
 func (bp *BytePipe) ReadFrom(r io.Reader) (n int64, err error) {
+	return bp.ReadFromContext(context.Background(), r)
+}
+
+// ReadFrom() with a context.
+// The ctx is checked between reads from r, and while waiting for a free slot of a bounded pipe.
+// Note that a Read() call blocked in r cannot be interrupted by the ctx.
+func (bp *BytePipe) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
 	bufSize := bp.ReadFromSize
 	if bufSize == 0 {
 		bufSize = ReadFromBufSize
 	}
+	stream := bp.StreamReadFrom
+	size := bufSize
+	if bp.AdaptiveReadFrom && size > minAdaptiveReadSize {
+		size = minAdaptiveReadSize
+	}
+	// keep the order with the data written before
+	if err = bp.Flush(); err != nil {
+		return
+	}
+	pooled := bp.UsePool
+	var buf, scratch []byte
+	defer func() {
+		if pooled {
+			putBuf(scratch)
+			bp.recycle(buf)
+		}
+	}()
 	for {
-		buf := make([]byte, bufSize)
-		sz, e := io.ReadFull(r, buf)
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var rbuf []byte // buffer for the read
+		if pooled && stream {
+			// a pooled block cannot be shared; read into a scratch buffer and copy to a block of the read size
+			if len(scratch) != size {
+				putBuf(scratch)
+				scratch = getBuf(size)
+			}
+			rbuf = scratch
+		} else {
+			if len(buf) == 0 || (stream && len(buf) < minStreamReadSize) {
+				buf = bp.alloc(size)
+			}
+			rbuf = buf
+		}
+		var sz int
+		var e error
+		if stream {
+			sz, e = r.Read(rbuf)
+		} else {
+			sz, e = io.ReadFull(r, rbuf)
+		}
 		if sz > 0 {
-			bp.Append(buf[:sz])
+			var block []byte
+			switch {
+			case pooled && stream:
+				block = bp.alloc(sz)
+				copy(block, rbuf)
+			case pooled:
+				// the buffer is not reused after a short read
+				block, buf = rbuf[:sz], nil
+			default:
+				// cap the block so the rest of the buffer can be used for the next read
+				block, buf = rbuf[:sz:sz], rbuf[sz:]
+			}
+			_, err = bp.AppendContext(ctx, block)
+			if err != nil {
+				bp.recycle(block)
+				break
+			}
+			if bp.AdaptiveReadFrom {
+				size = adaptReadSize(size, sz, len(rbuf), bufSize)
+			}
 		}
 		n += int64(sz)
 		if e != nil {
-			if e == io.ErrUnexpectedEOF || e == io.EOF {
+			if e == io.EOF || (!stream && e == io.ErrUnexpectedEOF) {
 				// end of data
 				e = nil
 			}
@@ -100,19 +431,418 @@ func (bp *BytePipe) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 
+// adjust the block size of adaptive ReadFrom() by the result of a read of sz bytes into a buffer of l bytes
+func adaptReadSize(size, sz, l, max int) int {
+	if sz == l {
+		// the read filled the buffer; more data may be waiting
+		if size *= 2; size > max {
+			size = max
+		}
+	} else if sz < size/4 {
+		if size /= 2; size < minAdaptiveReadSize {
+			size = minAdaptiveReadSize
+		}
+	}
+	return size
+}
+
 // io.Writer interface for BytePipe.
 // The data is copied from the provided buffer to an internal buffer when writing.
 // Use Append() for zero-copy data passing.
+//
+// If bp.CoalesceSize > 0, then a write smaller than CoalesceSize is merged into an open block,
+// which is appended to the pipe when it is full or a reader is waiting.
+// The data in the open block is visible to Read(), Fetch() and Receive() as soon as Write() returns.
+// Use Flush() before mixing Append() with coalescing Write(), to keep the order of the data.
 func (bp *BytePipe) Write(p []byte) (n int, err error) {
+	return bp.WriteContext(context.Background(), p)
+}
+
+// Write with a context.
+// The ctx is used while waiting for a free slot of a bounded pipe, or for the readers to go under bp.MaxBufferedBytes.
+func (bp *BytePipe) WriteContext(ctx context.Context, p []byte) (n int, err error) {
 	l := len(p)
 	if l == 0 {
 		return 0, nil
 	}
-	data := make([]byte, l)
+	if bp.CoalesceSize > 0 {
+		return bp.writeCoalesce(ctx, p)
+	}
+	data := bp.alloc(l)
 	copy(data, p)
-	_, err = bp.Append(data)
+	_, err = bp.AppendContext(ctx, data)
 	if err == nil {
 		n = l
+	} else {
+		bp.recycle(data)
+	}
+	return
+}
+
+// coalescing Write()
+func (bp *BytePipe) writeCoalesce(ctx context.Context, p []byte) (n int, err error) {
+	// the bytes are reserved before the write is started, so that the drop callbacks can close the pipe
+	dropped, err := bp.reserveBytes(ctx, p, true)
+	if err != nil {
+		return
+	} else if dropped {
+		return len(p), nil
+	}
+	if !bp.beginWrite() {
+		bp.freeBytes(len(p))
+		err = bp.closedErr()
+		return
 	}
+	defer bp.endWrite()
+	bp.wmu.Lock()
+	defer bp.wmu.Unlock()
+
+	size := bp.CoalesceSize
+	bp.mu.Lock()
+	if len(p) >= size || len(bp.openBuf)+len(p) > size {
+		// no room for p; append the open block first
+		full := bp.takeOpen()
+		bp.mu.Unlock()
+		if err = bp.appendOpen(ctx, full); err != nil {
+			// the open block is kept; only p is dropped
+			bp.freeBytes(len(p))
+			return
+		}
+		if len(p) >= size {
+			data := bp.alloc(len(p))
+			copy(data, p)
+			if _, err = bp.Pipe.AppendContext(ctx, data); err != nil {
+				bp.freeBytes(len(p))
+				bp.recycle(data)
+				return
+			}
+			atomic.AddUint64(&bp.bytesWritten, uint64(len(p)))
+			n = len(p)
+			return
+		}
+		bp.mu.Lock()
+	}
+	if bp.openBuf == nil {
+		bp.openBuf = bp.alloc(size)[:0]
+	}
+	bp.openBuf = append(bp.openBuf, p...)
+	atomic.StoreInt64(&bp.openLen, int64(len(bp.openBuf)))
+	atomic.AddUint64(&bp.bytesWritten, uint64(len(p)))
+	var full []byte
+	if len(bp.openBuf) >= size || atomic.LoadInt32(&bp.readers.count) > 0 {
+		// the block is full, or a reader is waiting for the data
+		full = bp.takeOpen()
+	}
+	bp.mu.Unlock()
+
+	if err = bp.appendOpen(ctx, full); err != nil {
+		// the open block is put back; take p out of it
+		bp.mu.Lock()
+		bp.openBuf = bp.openBuf[:len(bp.openBuf)-len(p)]
+		atomic.StoreInt64(&bp.openLen, int64(len(bp.openBuf)))
+		bp.mu.Unlock()
+		atomic.AddUint64(&bp.bytesWritten, ^uint64(len(p)-1))
+		bp.freeBytes(len(p))
+		return
+	}
+	n = len(p)
+	return
+}
+
+// append a block taken out of the open block. The bytes of the block are already counted.
+// If the append fails, then the block is put back as the open block, so the data written before are not lost.
+// The caller must hold the write lock and be counted by beginWrite(), so that CloseRead() discards the block put back.
+func (bp *BytePipe) appendOpen(ctx context.Context, p []byte) (err error) {
+	if p == nil {
+		return
+	}
+	if _, err = bp.Pipe.AppendContext(ctx, p); err != nil {
+		bp.mu.Lock()
+		bp.openBuf = p
+		atomic.StoreInt64(&bp.openLen, int64(len(p)))
+		bp.mu.Unlock()
+	}
+	return
+}
+
+// Append the open block of coalescing Write() to the pipe.
+// Returns the error of Append(), if any. The open block is kept on an error, and can still be read.
+func (bp *BytePipe) Flush() (err error) {
+	if atomic.LoadInt64(&bp.openLen) == 0 {
+		return
+	}
+	if !bp.beginWrite() {
+		err = bp.closedErr()
+		return
+	}
+	defer bp.endWrite()
+	bp.wmu.Lock()
+	defer bp.wmu.Unlock()
+	bp.mu.Lock()
+	full := bp.takeOpen()
+	bp.mu.Unlock()
+	return bp.appendOpen(context.Background(), full)
+}
+
+// take the open block out; the lock must be held. Returns nil if the block is empty.
+func (bp *BytePipe) takeOpen() (p []byte) {
+	if len(bp.openBuf) > 0 {
+		p = bp.openBuf
+	}
+	bp.openBuf = nil
+	atomic.StoreInt64(&bp.openLen, 0)
+	return
+}
+
+// the fill() hook of the Pipe; hands the open block over to a reader of an empty queue
+func (bp *BytePipe) fillOpen() (p []byte, ok bool) {
+	if atomic.LoadInt64(&bp.openLen) == 0 {
+		return
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	// a block taken out before the open block could be queued after the caller checked the queue
+	if p, ok = bp.queue.Dequeue(); ok {
+		bp.release()
+		return
+	}
+	p = bp.takeOpen()
+	ok = p != nil
+	return
+}
+
+// the fillable() hook of the Pipe
+func (bp *BytePipe) hasOpen() bool {
+	return atomic.LoadInt64(&bp.openLen) > 0
+}
+
+// Number of unread bytes in the BytePipe, including the rest of a partially read block.
+// Note that Len() is the number of data blocks, not bytes.
+func (bp *BytePipe) Buffered() int {
+	return int(atomic.LoadInt64(&bp.buffered))
+}
+
+// Total number of bytes written to the BytePipe.
+func (bp *BytePipe) BytesWritten() uint64 {
+	return atomic.LoadUint64(&bp.bytesWritten)
+}
+
+// Total number of bytes read from the BytePipe.
+// Data blocks taken by Fetch() and Receive() are counted as a whole.
+func (bp *BytePipe) BytesRead() uint64 {
+	return atomic.LoadUint64(&bp.bytesRead)
+}
+
+// Append a data block to the BytePipe, counting the bytes. See Pipe.Append().
+// If the bp.MaxBufferedBytes limit is exceeded, then the function works as the Overflow policy.
+func (bp *BytePipe) Append(p []byte) (n int, err error) {
+	return bp.AppendContext(context.Background(), p)
+}
+
+// Append a data block to the BytePipe without blocking. See Pipe.TryAppend().
+// If the bp.MaxBufferedBytes limit is exceeded, then the data is dropped as the Overflow policy,
+// or ErrFull is returned on Block and Reject policy.
+func (bp *BytePipe) TryAppend(p []byte) (n int, err error) {
+	dropped, err := bp.reserveBytes(context.Background(), p, false)
+	if err != nil || dropped {
+		n = bp.queue.Len()
+		return
+	}
+	n, err = bp.Pipe.TryAppend(p)
+	bp.endAppend(len(p), err)
+	return
+}
+
+// Append a data block to the BytePipe with a context. See Pipe.AppendContext().
+// If the bp.MaxBufferedBytes limit is exceeded, then the function blocks with Block policy, or works as TryAppend() with other policies.
+func (bp *BytePipe) AppendContext(ctx context.Context, p []byte) (n int, err error) {
+	dropped, err := bp.reserveBytes(ctx, p, true)
+	if err != nil || dropped {
+		n = bp.queue.Len()
+		return
+	}
+	n, err = bp.Pipe.AppendContext(ctx, p)
+	bp.endAppend(len(p), err)
+	return
+}
+
+// Get a data block from the BytePipe, counting the bytes as read. See Pipe.Fetch().
+// If a block is partially read by Read() or alike, or merged by Peek(), then the rest of it is returned first.
+func (bp *BytePipe) Fetch() (p []byte, err error) {
+	if p, ok := bp.tryTakeActive(); ok {
+		return p, nil
+	}
+	p, err = bp.Pipe.Fetch()
+	if err == nil {
+		bp.disown(p)
+		bp.consumeBytes(len(p))
+	}
+	return
+}
+
+// Receive a data block from the BytePipe, counting the bytes as read. See Pipe.Receive().
+// The rest of a partially read block is returned first, as Fetch().
+func (bp *BytePipe) Receive(ctx context.Context) (p []byte, err error) {
+	if p, ok := bp.tryTakeActive(); ok {
+		return p, nil
+	}
+	p, err = bp.Pipe.Receive(ctx)
+	if err == nil {
+		bp.disown(p)
+		bp.consumeBytes(len(p))
+	}
+	return
+}
+
+// Receive a data block from the BytePipe, waiting at most for the duration d. See Pipe.ReceiveTimeout().
+func (bp *BytePipe) ReceiveTimeout(d time.Duration) (p []byte, err error) {
+	if p, ok := bp.tryTakeActive(); ok {
+		return p, nil
+	}
+	p, err = bp.Pipe.ReceiveTimeout(d)
+	if err == nil {
+		bp.disown(p)
+		bp.consumeBytes(len(p))
+	}
+	return
+}
+
+// take the rest of the active buffer out. The block is handed over to the caller, and not released.
+// If another reader holds the read lock, then the active buffer belongs to it and ok is false.
+func (bp *BytePipe) tryTakeActive() (p []byte, ok bool) {
+	select {
+	case bp.rsem <- struct{}{}:
+	default:
+		return
+	}
+	defer bp.unlockRead()
+	if len(bp.activeBuf) == 0 {
+		return
+	}
+	p, ok = bp.activeBuf, true
+	bp.disown(bp.activeBlock)
+	bp.activeBuf, bp.activeBlock = nil, nil
+	bp.lastByte, bp.lastRuneSize = -1, -1
+	bp.consumeBytes(len(p))
 	return
 }
+
+// reserve the bytes of p in the buffer.
+// If the MaxBufferedBytes limit is exceeded, then the function works as the Overflow policy.
+// With Block policy, the function waits if wait is set, or returns ErrFull otherwise. Reject policy returns ErrFull.
+// With DropNewest policy, p is dropped and dropped is true. With DropOldest policy, the oldest blocks are dropped until p fits.
+// A write larger than the limit is accepted when the buffer is empty.
+func (bp *BytePipe) reserveBytes(ctx context.Context, p []byte, wait bool) (dropped bool, err error) {
+	n := len(p)
+	for {
+		if bp.tryReserveBytes(n) {
+			return
+		}
+		if bp.Overflow != Block && !bp.isOpen() {
+			return false, bp.closedErr()
+		}
+		switch bp.Overflow {
+		case Reject:
+			return false, ErrFull
+
+		case DropNewest:
+			// count the bytes to be freed by the drop hook
+			atomic.AddInt64(&bp.buffered, int64(n))
+			bp.drop(p)
+			return true, nil
+
+		case DropOldest:
+			if old, ok := bp.queue.Dequeue(); ok {
+				bp.release()
+				bp.drop(old)
+				continue
+			}
+			// nothing to drop in the queue; accept p over the limit
+			atomic.AddInt64(&bp.buffered, int64(n))
+			return
+		}
+		if !wait {
+			return false, ErrFull
+		}
+
+		// register a waiter
+		w := bp.space.add()
+
+		// the readers could catch up, or the pipe could be closed, before the registration
+		if bp.tryReserveBytes(n) {
+			bp.space.cancel(w)
+			bp.space.recycle(w)
+			return
+		}
+		if !bp.isOpen() {
+			bp.space.cancel(w)
+			bp.space.recycle(w)
+			return false, bp.closedErr()
+		}
+
+		select {
+		case <-w.ch: // some bytes are read
+			bp.space.recycle(w)
+
+		case <-ctx.Done(): // context error
+			bp.space.cancel(w)
+			bp.space.recycle(w)
+			if err = ctx.Err(); err == nil {
+				err = context.Canceled
+			}
+			return
+
+		case <-bp.writeCloseCh: // the BytePipe is closed
+			bp.space.cancel(w)
+			bp.space.recycle(w)
+			return false, bp.closedErr()
+		}
+	}
+}
+
+func (bp *BytePipe) tryReserveBytes(n int) bool {
+	max := int64(bp.MaxBufferedBytes)
+	for {
+		b := atomic.LoadInt64(&bp.buffered)
+		if max > 0 && b > 0 && b+int64(n) > max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&bp.buffered, b, b+int64(n)) {
+			if max > 0 && b+int64(n) < max {
+				// there could be a room for another waiting writer
+				bp.space.wakeOne()
+			}
+			return true
+		}
+	}
+}
+
+// finish an append of n bytes reserved by reserveBytes()
+func (bp *BytePipe) endAppend(n int, err error) {
+	if err != nil {
+		bp.freeBytes(n)
+		return
+	}
+	atomic.AddUint64(&bp.bytesWritten, uint64(n))
+}
+
+// count n bytes as read
+func (bp *BytePipe) consumeBytes(n int) {
+	atomic.AddUint64(&bp.bytesRead, uint64(n))
+	bp.freeBytes(n)
+}
+
+// count n bytes read as unread again
+func (bp *BytePipe) restoreBytes(n int) {
+	atomic.AddUint64(&bp.bytesRead, ^uint64(n-1))
+	atomic.AddInt64(&bp.buffered, int64(n))
+}
+
+// remove n bytes from the buffered bytes, and wake a writer waiting for the MaxBufferedBytes limit
+func (bp *BytePipe) freeBytes(n int) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&bp.buffered, -int64(n))
+	bp.space.wakeOne()
+}
@@ -1,9 +1,18 @@
 package bufpipe
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestBytePipeWrite(t *testing.T) {
@@ -177,3 +186,960 @@ func TestBytePipeReadFrom(t *testing.T) {
 	}
 
 }
+
+func TestBytePipeOverflow(t *testing.T) {
+	bp := NewBoundedBytePipe(2)
+	bp.Overflow = DropOldest
+	var droppedBytes int
+	bp.OnDrop = func(p []byte) {
+		droppedBytes += len(p)
+	}
+	for _, s := range []string{"abc", "def", "ghi", "jkl"} {
+		n, err := bp.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("write failed: %d, %v", n, err)
+		}
+	}
+	bp.Close()
+	if bp.Dropped() != 2 || droppedBytes != 6 {
+		t.Errorf("dropped count mismatch; blocks %d, bytes %d", bp.Dropped(), droppedBytes)
+	}
+	b, err := io.ReadAll(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ghijkl" {
+		t.Errorf("read data mismatch: %s", b)
+	}
+
+	// Reject makes Write() fail
+	bp = NewBoundedBytePipe(1)
+	bp.Overflow = Reject
+	if _, err := bp.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bp.Write([]byte("def")); err != ErrFull || n != 0 {
+		t.Errorf("Write on a full pipe must return ErrFull, actual %d, %v", n, err)
+	}
+}
+
+func TestBytePipeCloseWithError(t *testing.T) {
+	closeErr := errors.New("producer failed")
+	bp := NewBytePipe()
+	bp.Write([]byte("hello"))
+	bp.CloseWithError(closeErr)
+
+	b, err := io.ReadAll(bp)
+	if err != closeErr {
+		t.Errorf("Read must return the close error, actual %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("read data mismatch: %s", b)
+	}
+	if !bp.EOF() {
+		t.Errorf("drained pipe must be EOF")
+	}
+}
+
+func TestBytePipeCloseRead(t *testing.T) {
+	readErr := errors.New("consumer gone")
+	bp := NewBytePipe()
+	bp.Write([]byte("hello"))
+	bp.Write([]byte("world"))
+
+	buf := make([]byte, 3)
+	if n, err := bp.Read(buf); err != nil || n != 3 {
+		t.Fatalf("read failed: %d, %v", n, err)
+	}
+	if n := bp.CloseRead(readErr); n != 7 {
+		t.Errorf("discarded bytes mismatch; expected 7, actual %d", n)
+	}
+	if _, err := bp.Write([]byte("again")); err != readErr {
+		t.Errorf("Write must return the CloseRead error, actual %v", err)
+	}
+	src := NewBytePipe()
+	src.Write([]byte("source"))
+	src.Close()
+	if _, err := bp.ReadFrom(src); err != readErr {
+		t.Errorf("ReadFrom must return the CloseRead error, actual %v", err)
+	}
+	if _, err := bp.Read(buf); err != io.ErrClosedPipe {
+		t.Errorf("Read must return io.ErrClosedPipe, actual %v", err)
+	}
+}
+
+// writes at most limit bytes, then fails
+type testLimitWriter struct {
+	buf   bytes.Buffer
+	limit int
+	short bool // return a short write without an error
+}
+
+func (w *testLimitWriter) Write(p []byte) (n int, err error) {
+	if len(p) > w.limit {
+		p = p[:w.limit]
+		if !w.short {
+			err = errors.New("writer full")
+		}
+	}
+	n, _ = w.buf.Write(p)
+	w.limit -= n
+	return
+}
+
+func TestBytePipeWriteTo(t *testing.T) {
+	bp := NewBytePipe()
+	go func() {
+		for i := 0; i < 100; i++ {
+			bp.Write(bytes.Repeat([]byte{byte(i)}, i))
+		}
+		bp.Close()
+	}()
+
+	// partially read first
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(bp, head); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	n, err := io.Copy(&out, bp) // uses WriteTo
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 99 * 100 / 2
+	if int(n) != total-10 || out.Len() != total-10 {
+		t.Errorf("data size mismatch; expected %d, actual %d", total-10, n)
+	}
+	all := append(head, out.Bytes()...)
+	offset := 0
+	for i := 0; i < 100; i++ {
+		for j := 0; j < i; j++ {
+			if int(all[offset]) != i {
+				t.Fatalf("read data mismatch: offset %d, value %d", offset, all[offset])
+			}
+			offset++
+		}
+	}
+
+	// a failing writer keeps the rest in the pipe
+	bp = NewBytePipe()
+	bp.Write([]byte("hello"))
+	bp.Write([]byte("world"))
+	bp.Close()
+	lw := &testLimitWriter{limit: 7}
+	n, err = bp.WriteTo(lw)
+	if err == nil || n != 7 || lw.buf.String() != "hellowo" {
+		t.Errorf("unexpected WriteTo result: %d, %v, %q", n, err, lw.buf.String())
+	}
+	sw := &testLimitWriter{limit: 1, short: true}
+	n, err = bp.WriteTo(sw)
+	if err != io.ErrShortWrite || n != 1 {
+		t.Errorf("WriteTo must return io.ErrShortWrite, actual %d, %v", n, err)
+	}
+	rest, _ := io.ReadAll(bp)
+	if string(rest) != "ld" {
+		t.Errorf("remaining data mismatch: %q", rest)
+	}
+
+	// context and close error
+	bp = NewBytePipe()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = bp.WriteToContext(ctx, io.Discard)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("WriteToContext must return context error, actual %v", err)
+	}
+	closeErr := errors.New("producer failed")
+	bp.Write([]byte("abc"))
+	bp.CloseWithError(closeErr)
+	n, err = bp.WriteTo(io.Discard)
+	if err != closeErr || n != 3 {
+		t.Errorf("WriteTo must return the close error, actual %d, %v", n, err)
+	}
+}
+
+func TestBytePipeStreamReadFrom(t *testing.T) {
+	src, srcw := io.Pipe()
+	bp := NewBytePipe()
+	bp.StreamReadFrom = true
+
+	done := make(chan error)
+	go func() {
+		_, err := bp.ReadFrom(src)
+		bp.Close()
+		done <- err
+	}()
+
+	// each write reaches the reader before the source is closed
+	var all []byte
+	for i := 0; i < 100; i++ {
+		msg := []byte(fmt.Sprintf("message %d;", i))
+		srcw.Write(msg)
+		all = append(all, msg...)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		b, err := bp.Receive(ctx)
+		cancel()
+		if err != nil || !bytes.Equal(b, msg) {
+			t.Fatalf("unexpected Receive result: %q, %v", b, err)
+		}
+		// blocks share the buffer, but must not overwrite each other
+		_ = append(b, 'x')
+	}
+	srcw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// bulk mode waits for a whole block
+	bp = NewBytePipe()
+	bp.ReadFromSize = 16
+	n, err := bp.ReadFrom(bytes.NewReader(all))
+	if err != nil || int(n) != len(all) {
+		t.Fatalf("unexpected ReadFrom result: %d, %v", n, err)
+	}
+	if bp.Len() != (len(all)+15)/16 {
+		t.Errorf("block count mismatch; expected %d, actual %d", (len(all)+15)/16, bp.Len())
+	}
+
+	// context is checked between reads
+	bp = NewBytePipe()
+	bp.StreamReadFrom = true
+	ctx, cancel := context.WithCancel(context.Background())
+	src, srcw = io.Pipe()
+	go func() {
+		srcw.Write([]byte("first"))
+		cancel()
+		srcw.Write([]byte("second"))
+		srcw.Close()
+	}()
+	n, err = bp.ReadFromContext(ctx, src)
+	src.Close()
+	if err != context.Canceled {
+		t.Errorf("ReadFromContext must return context error, actual %v", err)
+	}
+	b, _ := bp.Fetch()
+	if n < 5 || string(b) != "first" {
+		t.Errorf("unexpected data: %d, %q", n, b)
+	}
+}
+
+func TestBytePipeCoalesce(t *testing.T) {
+	bp := NewBytePipe()
+	bp.CoalesceSize = 16
+	for _, s := range []string{"abc", "def", "ghijk", "lmnopq", "r"} {
+		if n, err := bp.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("write failed: %d, %v", n, err)
+		}
+	}
+	// "abc"+"def"+"ghijk" is in the queue, and "lmnopqr" is in the open block
+	if bp.Len() != 1 {
+		t.Errorf("block count mismatch; expected 1, actual %d", bp.Len())
+	}
+	b, err := bp.Fetch()
+	if err != nil || string(b) != "abcdefghijk" {
+		t.Fatalf("unexpected Fetch result: %q, %v", b, err)
+	}
+	// the open block is visible to readers
+	b, err = bp.Fetch()
+	if err != nil || string(b) != "lmnopqr" {
+		t.Fatalf("unexpected Fetch result: %q, %v", b, err)
+	}
+	if _, err = bp.Fetch(); err != ErrNoData {
+		t.Fatalf("empty pipe must return ErrNoData, actual %v", err)
+	}
+
+	// a large write is appended as it is, after the open block
+	bp.Write([]byte("small"))
+	bp.Write(bytes.Repeat([]byte{'x'}, 20))
+	bp.Write([]byte("tail"))
+	bp.Close()
+	for _, s := range []string{"small", strings.Repeat("x", 20), "tail"} {
+		b, err = bp.Fetch()
+		if err != nil || string(b) != s {
+			t.Fatalf("unexpected Fetch result: %q, %v", b, err)
+		}
+	}
+	if _, err = bp.Fetch(); err != io.EOF {
+		t.Fatalf("drained pipe must return io.EOF, actual %v", err)
+	}
+	if _, err = bp.Write([]byte("again")); err != io.ErrClosedPipe {
+		t.Errorf("Write on a closed pipe must return io.ErrClosedPipe, actual %v", err)
+	}
+
+	// a waiting reader receives a small write at once
+	bp = NewBytePipe()
+	bp.CoalesceSize = 1024
+	go func() {
+		for i := 0; i < 100; i++ {
+			time.Sleep(time.Microsecond)
+			bp.Write([]byte(fmt.Sprintf("%d;", i)))
+		}
+		bp.Close()
+	}()
+	var all []byte
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		b, err := bp.Receive(ctx)
+		cancel()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, b...)
+	}
+	var expected []byte
+	for i := 0; i < 100; i++ {
+		expected = append(expected, fmt.Sprintf("%d;", i)...)
+	}
+	if !bytes.Equal(all, expected) {
+		t.Errorf("read data mismatch: %q", all)
+	}
+
+	// concurrent writers and readers
+	bp = NewBytePipe()
+	bp.CoalesceSize = 64
+	var wg sync.WaitGroup
+	total := 0
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				bp.Write([]byte{byte(w)})
+			}
+		}(w)
+		total += 1000
+	}
+	go func() {
+		wg.Wait()
+		bp.Close()
+	}()
+	counts := make([]int, 4)
+	buf := make([]byte, 7)
+	for {
+		n, err := bp.Read(buf)
+		for _, c := range buf[:n] {
+			counts[c]++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for w, c := range counts {
+		if c != 1000 {
+			t.Errorf("data count mismatch for writer %d: %d", w, c)
+		}
+	}
+
+	// CloseRead discards the open block
+	bp = NewBytePipe()
+	bp.CoalesceSize = 16
+	bp.Write([]byte("hello"))
+	if n := bp.CloseRead(nil); n != 5 {
+		t.Errorf("discarded bytes mismatch; expected 5, actual %d", n)
+	}
+}
+
+func TestBytePipeCoalesceFailedAppend(t *testing.T) {
+	// a failed append of the open block must not lose the data of the earlier writes
+	for _, cancel := range []bool{false, true} {
+		bp := NewBoundedBytePipe(1)
+		bp.CoalesceSize = 4
+		for _, s := range []string{"ab", "cd", "ef"} {
+			if n, err := bp.Write([]byte(s)); err != nil || n != len(s) {
+				t.Fatalf("write failed: %d, %v", n, err)
+			}
+		}
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			// blocks on appending the open block to the full pipe
+			_, err := bp.WriteContext(ctx, []byte("ghij"))
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if cancel {
+			cancelFunc()
+		} else {
+			bp.Close()
+		}
+		if err := <-done; err == nil {
+			t.Errorf("the blocked write must fail")
+		}
+		cancelFunc()
+		bp.Close()
+		b, err := io.ReadAll(bp)
+		if err != nil || string(b) != "abcdef" {
+			t.Errorf("unexpected data: %q, %v", b, err)
+		}
+		if bp.Buffered() != 0 || bp.BytesWritten() != 6 {
+			t.Errorf("unexpected accounting: %d, %d", bp.Buffered(), bp.BytesWritten())
+		}
+	}
+}
+
+func TestBytePipeAdaptiveReadFrom(t *testing.T) {
+	// a small input does not allocate a whole block
+	bp := NewBytePipe()
+	bp.AdaptiveReadFrom = true
+	if _, err := bp.ReadFrom(strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := bp.Fetch()
+	if string(b) != "hello" || cap(b) > minAdaptiveReadSize {
+		t.Errorf("unexpected block: %q, cap %d", b, cap(b))
+	}
+
+	// blocks grow while the reads fill them
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	bp = NewBytePipe()
+	bp.AdaptiveReadFrom = true
+	bp.ReadFromSize = 32 * 1024
+	n, err := bp.ReadFrom(bytes.NewReader(data))
+	if err != nil || int(n) != len(data) {
+		t.Fatalf("unexpected ReadFrom result: %d, %v", n, err)
+	}
+	var sizes []int
+	var all []byte
+	for {
+		b, err := bp.Fetch()
+		if err != nil {
+			break
+		}
+		sizes = append(sizes, len(b))
+		all = append(all, b...)
+	}
+	if !bytes.Equal(all, data) {
+		t.Fatalf("read data mismatch")
+	}
+	expected := []int{4096, 8192, 16384, 32768, 32768}
+	for i, sz := range expected {
+		if i >= len(sizes) || sizes[i] != sz {
+			t.Fatalf("block sizes mismatch: %v", sizes)
+		}
+	}
+
+	// adaptReadSize shrinks on small reads
+	if sz := adaptReadSize(64*1024, 100, 64*1024, 1024*1024); sz != 32*1024 {
+		t.Errorf("block size must shrink, actual %d", sz)
+	}
+	if sz := adaptReadSize(minAdaptiveReadSize, 1, minAdaptiveReadSize, 1024*1024); sz != minAdaptiveReadSize {
+		t.Errorf("block size must not shrink below the min, actual %d", sz)
+	}
+}
+
+func BenchmarkBytePipeSmallWrite(b *testing.B) {
+	msg := []byte("0123456789")
+	bench := func(b *testing.B, coalesce int) {
+		bp := NewBytePipe()
+		bp.CoalesceSize = coalesce
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			bp.Write(msg)
+		}
+		bp.Flush()
+		b.StopTimer()
+		b.ReportMetric(float64(bp.Len())/float64(b.N), "blocks/write")
+		bp.Close()
+		bp.WriteTo(io.Discard)
+	}
+	b.Run("plain", func(b *testing.B) {
+		bench(b, 0)
+	})
+	b.Run("coalesce=4k", func(b *testing.B) {
+		bench(b, 4096)
+	})
+}
+
+func BenchmarkBytePipeReadFrom(b *testing.B) {
+	for _, size := range []int{100, 100 * 1024} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		bench := func(b *testing.B, adaptive bool) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				bp := NewBytePipe()
+				bp.AdaptiveReadFrom = adaptive
+				bp.ReadFrom(bytes.NewReader(data))
+				bp.Close()
+				bp.WriteTo(io.Discard)
+			}
+		}
+		b.Run(fmt.Sprintf("fixed/size=%d", size), func(b *testing.B) {
+			bench(b, false)
+		})
+		b.Run(fmt.Sprintf("adaptive/size=%d", size), func(b *testing.B) {
+			bench(b, true)
+		})
+	}
+}
+
+func TestBytePipePool(t *testing.T) {
+	if b := getBuf(100); len(b) != 100 || cap(b) != 128 {
+		t.Errorf("unexpected pooled buffer: len %d, cap %d", len(b), cap(b))
+	}
+	if b := getBuf(10); cap(b) != 1<<minPoolClass {
+		t.Errorf("unexpected pooled buffer: cap %d", cap(b))
+	}
+	if b := getBuf(1<<maxPoolClass + 1); cap(b) != 1<<maxPoolClass+1 {
+		t.Errorf("a large buffer must not be pooled: cap %d", cap(b))
+	}
+
+	// Read() works with pooled blocks
+	bp := NewBytePipe()
+	bp.UsePool = true
+	go func() {
+		for i := 0; i < 100; i++ {
+			bp.Write(bytes.Repeat([]byte{byte(i)}, i))
+		}
+		bp.Close()
+	}()
+	all, err := io.ReadAll(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := 0
+	for i := 0; i < 100; i++ {
+		for j := 0; j < i; j++ {
+			if int(all[offset]) != i {
+				t.Fatalf("read data mismatch: offset %d, value %d", offset, all[offset])
+			}
+			offset++
+		}
+	}
+
+	// ReadFrom() in both modes, drained by Fetch() and Release()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, stream := range []bool{false, true} {
+		bp = NewBytePipe()
+		bp.UsePool = true
+		bp.StreamReadFrom = stream
+		bp.ReadFromSize = 1000
+		src := NewBytePipe()
+		for i := 0; i < len(data); i += 700 {
+			end := i + 700
+			if end > len(data) {
+				end = len(data)
+			}
+			src.Append(data[i:end])
+		}
+		src.Close()
+		n, err := bp.ReadFrom(src)
+		if err != nil || int(n) != len(data) {
+			t.Fatalf("unexpected ReadFrom result: %d, %v", n, err)
+		}
+		bp.Close()
+		var out []byte
+		for {
+			b, err := bp.Fetch()
+			if err != nil {
+				break
+			}
+			if c := cap(b); c&(c-1) != 0 {
+				t.Errorf("a block must have a pooled capacity: %d", c)
+			}
+			out = append(out, b...)
+			bp.Release(b)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("read data mismatch (stream %v)", stream)
+		}
+	}
+
+	// Release() does nothing on a non-pooled pipe
+	bp = NewBytePipe()
+	b := make([]byte, 64)
+	bp.Release(b)
+	if c := getBuf(64); &c[:1][0] == &b[0] {
+		t.Errorf("a block of a non-pooled pipe must not be pooled")
+	}
+}
+
+func BenchmarkBytePipePool(b *testing.B) {
+	msg := bytes.Repeat([]byte{'x'}, 1000)
+	bench := func(b *testing.B, pooled bool) {
+		bp := NewBytePipe()
+		bp.UsePool = pooled
+		buf := make([]byte, 1000)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			bp.Write(msg)
+			bp.Read(buf)
+		}
+	}
+	b.Run("plain", func(b *testing.B) {
+		bench(b, false)
+	})
+	b.Run("pooled", func(b *testing.B) {
+		bench(b, true)
+	})
+}
+
+func TestBytePipePoolCallerBlock(t *testing.T) {
+	// a block passed to Append() must never be put into the pool
+	pooled := func(p []byte) bool {
+		for i := 0; i < 8; i++ {
+			if b := getBuf(len(p)); &b[:1][0] == &p[0] {
+				return true
+			}
+		}
+		return false
+	}
+	bp := NewBytePipe()
+	bp.UsePool = true
+	mine := make([]byte, 64)
+	bp.Append(mine)
+	bp.Append([]byte("x"))
+	buf := make([]byte, 65)
+	if n, err := io.ReadFull(bp, buf); n != 65 || err != nil {
+		t.Fatalf("unexpected read result: %d, %v", n, err)
+	}
+	if pooled(mine) {
+		t.Errorf("a caller block consumed by Read() must not be pooled")
+	}
+
+	// merged by Peek()
+	mine2 := make([]byte, 64)
+	bp.Append(mine)
+	bp.Append(mine2)
+	if p, err := bp.Peek(context.Background(), 65); len(p) != 65 || err != nil {
+		t.Fatalf("unexpected peek result: %d, %v", len(p), err)
+	}
+	if pooled(mine) || pooled(mine2) {
+		t.Errorf("a caller block merged by Peek() must not be pooled")
+	}
+
+	// discarded by CloseRead()
+	bp.Append(mine)
+	bp.CloseRead(nil)
+	if pooled(mine) {
+		t.Errorf("a caller block discarded by CloseRead() must not be pooled")
+	}
+}
+
+func TestBytePipeAccounting(t *testing.T) {
+	bp := NewBytePipe()
+	bp.Write([]byte("hello"))
+	bp.Write([]byte("world"))
+	bp.Append([]byte("!"))
+	if bp.Buffered() != 11 || bp.BytesWritten() != 11 || bp.Len() != 3 {
+		t.Errorf("unexpected counts: buffered %d, written %d, blocks %d", bp.Buffered(), bp.BytesWritten(), bp.Len())
+	}
+	buf := make([]byte, 3)
+	bp.Read(buf)
+	if bp.Buffered() != 8 || bp.BytesRead() != 3 {
+		t.Errorf("unexpected counts: buffered %d, read %d", bp.Buffered(), bp.BytesRead())
+	}
+	bp.Fetch() // the rest of "hello"
+	if bp.Buffered() != 6 || bp.BytesRead() != 5 {
+		t.Errorf("unexpected counts: buffered %d, read %d", bp.Buffered(), bp.BytesRead())
+	}
+	bp.Read(buf)
+	if n := bp.CloseRead(nil); n != 3 || bp.Buffered() != 0 {
+		t.Errorf("unexpected counts: discarded %d, buffered %d", n, bp.Buffered())
+	}
+
+	// coalescing writes and dropped blocks
+	bp = NewBoundedBytePipe(1)
+	bp.Overflow = DropOldest
+	bp.CoalesceSize = 4
+	for _, s := range []string{"ab", "cd", "ef", "gh"} {
+		bp.Write([]byte(s))
+	}
+	// "abcd" is dropped for "efgh"
+	if bp.Buffered() != 4 || bp.BytesWritten() != 8 || bp.Dropped() != 1 {
+		t.Errorf("unexpected counts: buffered %d, written %d, dropped %d", bp.Buffered(), bp.BytesWritten(), bp.Dropped())
+	}
+}
+
+func TestBytePipeMaxBufferedBytes(t *testing.T) {
+	bp := NewBytePipe()
+	bp.MaxBufferedBytes = 10
+	if _, err := bp.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bp.TryAppend([]byte("x")); err != ErrFull {
+		t.Errorf("TryAppend over the limit must return ErrFull, actual %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err := bp.WriteContext(ctx, []byte("x"))
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("WriteContext must return context error, actual %v", err)
+	}
+	if bp.Buffered() != 10 {
+		t.Errorf("a failed write must not be counted: %d", bp.Buffered())
+	}
+
+	// a blocked writer resumes when the reader catches up
+	done := make(chan error)
+	go func() {
+		_, err := bp.Write([]byte("abcde"))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("Write over the limit must block")
+	default:
+	}
+	buf := make([]byte, 4)
+	bp.Read(buf)
+	select {
+	case <-done:
+		t.Fatalf("Write over the limit must block")
+	case <-time.After(10 * time.Millisecond):
+	}
+	bp.Read(buf)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if bp.Buffered() != 7 {
+		t.Errorf("buffered bytes mismatch; expected 7, actual %d", bp.Buffered())
+	}
+
+	// a write larger than the limit is accepted on an empty pipe
+	bp = NewBytePipe()
+	bp.MaxBufferedBytes = 10
+	if _, err := bp.Write(make([]byte, 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close releases a blocked writer
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		bp.Close()
+	}()
+	if _, err := bp.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write on a closed pipe must return io.ErrClosedPipe, actual %v", err)
+	}
+
+	// many writers and a slow reader keep the limit
+	bp = NewBytePipe()
+	bp.MaxBufferedBytes = 100
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				bp.Write(make([]byte, 7))
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		bp.Close()
+	}()
+	var total int
+	for {
+		if b := bp.Buffered(); b > 100 {
+			t.Fatalf("buffered bytes over the limit: %d", b)
+		}
+		n, err := bp.Read(buf)
+		total += n
+		if err != nil {
+			break
+		}
+	}
+	if total != 8*100*7 || bp.BytesRead() != uint64(total) {
+		t.Errorf("data size mismatch: %d, %d", total, bp.BytesRead())
+	}
+}
+
+func TestBytePipeMaxBufferedBytesOverflow(t *testing.T) {
+	// Reject
+	bp := NewBytePipe()
+	bp.MaxBufferedBytes, bp.Overflow = 10, Reject
+	bp.Write([]byte("0123456789"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	_, err := bp.WriteContext(ctx, []byte("x"))
+	cancel()
+	if err != ErrFull {
+		t.Errorf("Write over the limit with Reject policy must return ErrFull, actual %v", err)
+	}
+
+	// DropNewest
+	bp = NewBytePipe()
+	bp.MaxBufferedBytes, bp.Overflow = 10, DropNewest
+	var dropped []string
+	bp.OnDrop = func(p []byte) { dropped = append(dropped, string(p)) }
+	bp.Write([]byte("0123456789"))
+	if n, err := bp.Write([]byte("xy")); n != 2 || err != nil {
+		t.Errorf("unexpected write result with DropNewest policy: %d, %v", n, err)
+	}
+	if bp.Buffered() != 10 || bp.Dropped() != 1 || len(dropped) != 1 || dropped[0] != "xy" {
+		t.Errorf("unexpected state after DropNewest: %d, %d, %q", bp.Buffered(), bp.Dropped(), dropped)
+	}
+
+	// DropOldest
+	bp = NewBytePipe()
+	bp.MaxBufferedBytes, bp.Overflow = 10, DropOldest
+	for _, s := range []string{"0123", "4567", "89"} {
+		bp.Write([]byte(s))
+	}
+	if _, err := bp.Write([]byte("abcde")); err != nil {
+		t.Fatal(err)
+	}
+	if bp.Buffered() != 7 || bp.Dropped() != 2 {
+		t.Errorf("unexpected state after DropOldest: %d, %d", bp.Buffered(), bp.Dropped())
+	}
+	bp.Close()
+	if b, _ := io.ReadAll(bp); string(b) != "89abcde" {
+		t.Errorf("unexpected data after DropOldest: %q", b)
+	}
+}
+
+func TestBytePipeConcurrentRead(t *testing.T) {
+	nWriters, nReaders, count := 4, 8, 2000
+
+	// write 8-byte blocks of unique tags
+	writeAll := func(bp *BytePipe) {
+		var wg sync.WaitGroup
+		for w := 0; w < nWriters; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < count; i++ {
+					var b [8]byte
+					binary.BigEndian.PutUint64(b[:], uint64(w*count+i))
+					bp.Write(b[:])
+				}
+			}(w)
+		}
+		wg.Wait()
+		bp.Close()
+	}
+
+	// Read() with 8-byte buffers gets whole blocks
+	bp := NewBytePipe()
+	go writeAll(bp)
+	seen := make([]int32, nWriters*count)
+	var wg sync.WaitGroup
+	for r := 0; r < nReaders; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 8)
+			for {
+				n, err := bp.Read(buf)
+				if err == io.EOF {
+					return
+				}
+				if err != nil || n != 8 {
+					t.Errorf("unexpected Read result: %d, %v", n, err)
+					return
+				}
+				tag := binary.BigEndian.Uint64(buf)
+				if tag >= uint64(len(seen)) {
+					t.Errorf("a block is torn: %x", buf)
+					return
+				}
+				atomic.AddInt32(&seen[tag], 1)
+			}
+		}()
+	}
+	wg.Wait()
+	for tag, c := range seen {
+		if c != 1 {
+			t.Fatalf("block %d is read %d times", tag, c)
+		}
+	}
+
+	// mixed read functions share the stream
+	bp = NewBytePipe()
+	go writeAll(bp)
+	var total, sum int64
+	for r := 0; r < nReaders; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			var n, s int64
+			defer func() {
+				atomic.AddInt64(&total, n)
+				atomic.AddInt64(&sum, s)
+			}()
+			buf := make([]byte, 3+r)
+			for {
+				var p []byte
+				var err error
+				switch r % 4 {
+				case 0:
+					var sz int
+					sz, err = bp.Read(buf)
+					p = buf[:sz]
+				case 1:
+					var c byte
+					if c, err = bp.ReadByte(); err == nil {
+						p = []byte{c}
+					}
+				case 2:
+					p, err = bp.Fetch()
+					if err == ErrNoData {
+						runtime.Gosched()
+						continue
+					}
+				case 3:
+					p, err = bp.ReadBytes(0)
+				}
+				n += int64(len(p))
+				for _, c := range p {
+					s += int64(c)
+				}
+				if err == io.EOF {
+					return
+				}
+				if err != nil && err != ErrNoData {
+					t.Error(err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	var expected int64
+	for tag := 0; tag < nWriters*count; tag++ {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(tag))
+		for _, c := range b {
+			expected += int64(c)
+		}
+	}
+	if total != int64(nWriters*count*8) || sum != expected {
+		t.Errorf("data mismatch: total %d, sum %d, expected sum %d", total, sum, expected)
+	}
+	if !bp.EOF() {
+		t.Errorf("drained pipe must be EOF")
+	}
+}
+
+// CloseRead() must wait for the read lock even if the read deadline is exceeded
+func TestBytePipeCloseReadLocked(t *testing.T) {
+	bp := NewBytePipe()
+	bp.Write([]byte("abc"))
+	bp.SetReadDeadline(time.Now().Add(-time.Second))
+	bp.lockRead(context.Background()) // a reader holding the lock, like a blocked WriteTo()
+
+	done := make(chan int)
+	go func() {
+		done <- bp.CloseRead(nil)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("CloseRead must wait for the read lock")
+	case <-time.After(10 * time.Millisecond):
+	}
+	bp.unlockRead()
+	if n := <-done; n != 3 {
+		t.Errorf("discarded count mismatch; expected 3, actual %d", n)
+	}
+	if len(bp.rsem) != 0 {
+		t.Errorf("the read lock must be released")
+	}
+}
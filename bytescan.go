@@ -0,0 +1,368 @@
+package bufpipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+var (
+	_ io.ByteScanner = (*BytePipe)(nil)
+	_ io.RuneScanner = (*BytePipe)(nil)
+)
+
+// Read a byte, like bufio.Reader.ReadByte().
+// The function blocks until a data is available, the pipe is closed, or the read deadline is exceeded.
+func (bp *BytePipe) ReadByte() (c byte, err error) {
+	if err = bp.lockRead(context.Background()); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	if err = bp.fillActive(); err != nil {
+		bp.lastRuneSize = -1
+		return
+	}
+	c = bp.activeBuf[0]
+	bp.activeBuf = bp.activeBuf[1:]
+	bp.lastByte, bp.lastRuneSize = int(c), -1
+	bp.consumeBytes(1)
+	return
+}
+
+// Unread the last byte, like bufio.Reader.UnreadByte().
+// Only the last byte read by ReadByte(), ReadRune(), ReadSlice() or Read() can be unread.
+func (bp *BytePipe) UnreadByte() error {
+	if err := bp.lockRead(context.Background()); err != nil {
+		return err
+	}
+	defer bp.unlockRead()
+	return bp.unreadByte()
+}
+
+// UnreadByte() with the read lock held
+func (bp *BytePipe) unreadByte() error {
+	if bp.lastByte < 0 {
+		return bufio.ErrInvalidUnreadByte
+	}
+	bp.pushBack([]byte{byte(bp.lastByte)})
+	bp.lastByte, bp.lastRuneSize = -1, -1
+	return nil
+}
+
+// Read a UTF-8 encoded rune, like bufio.Reader.ReadRune().
+// A rune split across data blocks is merged. An invalid encoding returns utf8.RuneError of size 1.
+func (bp *BytePipe) ReadRune() (r rune, size int, err error) {
+	if err = bp.lockRead(context.Background()); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	if err = bp.fillActive(); err != nil {
+		bp.lastRuneSize = -1
+		return
+	}
+	if c := bp.activeBuf[0]; c < utf8.RuneSelf {
+		bp.activeBuf = bp.activeBuf[1:]
+		bp.consumeBytes(1)
+		bp.lastRune[0] = c
+		bp.lastByte, bp.lastRuneSize = int(c), 1
+		return rune(c), 1, nil
+	}
+
+	// gather the bytes of a rune that could be split across the data blocks
+	var b [utf8.UTFMax]byte
+	n := 0
+	for {
+		sz := copy(b[n:], bp.activeBuf)
+		if utf8.FullRune(b[:n+sz]) {
+			r, size = utf8.DecodeRune(b[:n+sz])
+			if size >= n {
+				bp.activeBuf = bp.activeBuf[size-n:]
+				bp.consumeBytes(size - n)
+			} else {
+				// an invalid sequence shorter than the bytes gathered
+				bp.pushBack(b[size:n])
+			}
+			break
+		}
+		n += sz
+		bp.activeBuf = bp.activeBuf[sz:]
+		bp.consumeBytes(sz)
+		if e := bp.fillActive(); e != nil {
+			// an incomplete rune at the end of the data; return the first byte only
+			r, size = utf8.RuneError, 1
+			bp.pushBack(b[1:n])
+			break
+		}
+	}
+	copy(bp.lastRune[:], b[:size])
+	bp.lastByte, bp.lastRuneSize = int(b[size-1]), size
+	return
+}
+
+// Unread the last rune, like bufio.Reader.UnreadRune().
+// Only the rune read by the last ReadRune() can be unread.
+func (bp *BytePipe) UnreadRune() error {
+	if err := bp.lockRead(context.Background()); err != nil {
+		return err
+	}
+	defer bp.unlockRead()
+	if bp.lastRuneSize < 0 {
+		return bufio.ErrInvalidUnreadRune
+	}
+	bp.pushBack(bp.lastRune[:bp.lastRuneSize])
+	bp.lastByte, bp.lastRuneSize = -1, -1
+	return nil
+}
+
+// Read until the first occurrence of delim, like bufio.Reader.ReadSlice().
+// The returned slice points into the data block if the delim is found in the current block,
+// or into an internal buffer if the data spans multiple blocks.
+// The slice is valid only until the next read by any goroutine; concurrent readers should use ReadBytes() instead.
+// If bp.MaxSliceSize > 0 and no delim is found in MaxSliceSize bytes, then bufio.ErrBufferFull is returned with the data.
+// If the pipe is closed before the delim is found, then the data read and io.EOF, or the close error, are returned.
+func (bp *BytePipe) ReadSlice(delim byte) (line []byte, err error) {
+	if err = bp.lockRead(context.Background()); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	return bp.readSlice(delim)
+}
+
+// ReadSlice() with the read lock held
+func (bp *BytePipe) readSlice(delim byte) (line []byte, err error) {
+	if bp.readDeadline.expired() {
+		err = os.ErrDeadlineExceeded
+		return
+	}
+	max := bp.MaxSliceSize
+	bp.sliceBuf = bp.sliceBuf[:0]
+	for {
+		avail := bp.activeBuf
+		if max > 0 && len(bp.sliceBuf)+len(avail) > max {
+			avail = avail[:max-len(bp.sliceBuf)]
+		}
+		if i := bytes.IndexByte(avail, delim); i >= 0 {
+			line = bp.takeSlice(i + 1)
+			break
+		}
+		if max > 0 && len(bp.sliceBuf)+len(avail) == max {
+			line, err = bp.takeSlice(len(avail)), bufio.ErrBufferFull
+			break
+		}
+		bp.sliceBuf = append(bp.sliceBuf, avail...)
+		bp.activeBuf = bp.activeBuf[len(avail):]
+		bp.consumeBytes(len(avail))
+		if err = bp.nextBlock(context.Background(), true); err != nil {
+			line = bp.sliceBuf
+			break
+		}
+	}
+	// the last byte is kept if nothing is read, as bufio.Reader
+	bp.lastRuneSize = -1
+	if len(line) > 0 {
+		bp.lastByte = int(line[len(line)-1])
+	}
+	return
+}
+
+// take n bytes of the active buffer, appended to the data gathered in sliceBuf
+func (bp *BytePipe) takeSlice(n int) (line []byte) {
+	if len(bp.sliceBuf) == 0 {
+		// zero-copy; the block is released on the next read
+		line = bp.activeBuf[:n:n]
+	} else {
+		bp.sliceBuf = append(bp.sliceBuf, bp.activeBuf[:n]...)
+		line = bp.sliceBuf
+	}
+	bp.activeBuf = bp.activeBuf[n:]
+	bp.consumeBytes(n)
+	return
+}
+
+// Read until the first occurrence of delim, like bufio.Reader.ReadBytes().
+// The returned slice is a copy of the data, including the delim.
+func (bp *BytePipe) ReadBytes(delim byte) (line []byte, err error) {
+	if err = bp.lockRead(context.Background()); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	for {
+		var frag []byte
+		frag, err = bp.readSlice(delim)
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// Read until the first occurrence of delim, like bufio.Reader.ReadString().
+func (bp *BytePipe) ReadString(delim byte) (line string, err error) {
+	b, err := bp.ReadBytes(delim)
+	return string(b), err
+}
+
+// Read a line without the end-of-line bytes, like bufio.Reader.ReadLine().
+// If the line is longer than bp.MaxSliceSize, then isPrefix is set and the rest of the line is returned by the next calls.
+// The returned slice is valid only until the next read by any goroutine.
+func (bp *BytePipe) ReadLine() (line []byte, isPrefix bool, err error) {
+	if err = bp.lockRead(context.Background()); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	line, err = bp.readSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// handle the case where "\r\n" straddles the limit
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			bp.unreadByte()
+			line = line[:len(line)-1]
+		}
+		return line, true, nil
+	}
+	if len(line) == 0 {
+		if err != nil {
+			line = nil
+		}
+		return
+	}
+	err = nil
+	if line[len(line)-1] == '\n' {
+		drop := 1
+		if len(line) > 1 && line[len(line)-2] == '\r' {
+			drop = 2
+		}
+		line = line[:len(line)-drop]
+	}
+	return
+}
+
+// wait for a non-empty active buffer
+func (bp *BytePipe) fillActive() error {
+	if bp.readDeadline.expired() {
+		return os.ErrDeadlineExceeded
+	}
+	for len(bp.activeBuf) == 0 {
+		if err := bp.nextBlock(context.Background(), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put the bytes just read back to the front of the active buffer
+func (bp *BytePipe) pushBack(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if off := len(bp.activeBlock) - len(bp.activeBuf); bp.activeBlock != nil && off >= len(p) {
+		// the bytes are still in the current block
+		bp.activeBuf = bp.activeBlock[off-len(p):]
+	} else {
+		// the current block is left to the GC, since a slice returned by ReadSlice() may point into it
+		bp.disown(bp.activeBlock)
+		b := make([]byte, len(p)+len(bp.activeBuf))
+		copy(b, p)
+		copy(b[len(p):], bp.activeBuf)
+		bp.activeBuf, bp.activeBlock = b, b
+	}
+	bp.restoreBytes(len(p))
+}
+
+// Get the next n bytes without consuming them.
+// The function blocks until n bytes are buffered, the pipe is closed, the read deadline is exceeded, or the ctx.Done() is done.
+// If fewer than n bytes are available, then the bytes and the error are returned.
+// The data blocks are merged only if the n bytes span multiple blocks.
+// The returned slice is valid only until the next read by any goroutine.
+func (bp *BytePipe) Peek(ctx context.Context, n int) (p []byte, err error) {
+	if n < 0 {
+		return nil, bufio.ErrNegativeCount
+	}
+	if bp.readDeadline.expired() {
+		return nil, os.ErrDeadlineExceeded
+	}
+	if err = bp.lockRead(ctx); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	bp.lastByte, bp.lastRuneSize = -1, -1
+	if len(bp.activeBuf) < n {
+		// gather the blocks, then merge them at once
+		var blocks [][]byte
+		total := len(bp.activeBuf)
+		for total < n {
+			var next []byte
+			next, err = bp.Pipe.Fetch()
+			if err == ErrNoData {
+				next, err = bp.Pipe.Receive(ctx)
+			}
+			if err != nil {
+				break
+			}
+			blocks = append(blocks, next)
+			total += len(next)
+		}
+		bp.mergeActive(blocks, total)
+	}
+	if len(bp.activeBuf) >= n {
+		return bp.activeBuf[:n:n], nil
+	}
+	return bp.activeBuf[:len(bp.activeBuf):len(bp.activeBuf)], err
+}
+
+// merge the blocks to the end of the active buffer. total is the sum of the lengths.
+func (bp *BytePipe) mergeActive(blocks [][]byte, total int) {
+	switch {
+	case len(blocks) == 0:
+		return
+	case len(blocks) == 1 && len(bp.activeBuf) == 0:
+		bp.releaseActive()
+		bp.activeBuf, bp.activeBlock = blocks[0], blocks[0]
+		return
+	}
+	merged := bp.alloc(total)
+	off := copy(merged, bp.activeBuf)
+	for _, b := range blocks {
+		off += copy(merged[off:], b)
+		bp.recycle(b)
+	}
+	if bp.activeBlock != nil {
+		bp.recycle(bp.activeBlock)
+	}
+	bp.activeBuf, bp.activeBlock = merged, merged
+}
+
+// Skip the next n bytes without copying.
+// The function blocks until n bytes are skipped, the pipe is closed, or the read deadline is exceeded.
+// If fewer than n bytes are skipped, then the error is returned.
+func (bp *BytePipe) Discard(n int) (discarded int, err error) {
+	if n < 0 {
+		return 0, bufio.ErrNegativeCount
+	}
+	if bp.readDeadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err = bp.lockRead(context.Background()); err != nil {
+		return
+	}
+	defer bp.unlockRead()
+	bp.lastByte, bp.lastRuneSize = -1, -1
+	for discarded < n {
+		if len(bp.activeBuf) == 0 {
+			if err = bp.nextBlock(context.Background(), true); err != nil {
+				break
+			}
+		}
+		sz := n - discarded
+		if sz > len(bp.activeBuf) {
+			sz = len(bp.activeBuf)
+		}
+		bp.activeBuf = bp.activeBuf[sz:]
+		discarded += sz
+		bp.consumeBytes(sz)
+	}
+	bp.releaseActive()
+	return
+}
@@ -0,0 +1,328 @@
+package bufpipe
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// make a closed BytePipe of the data blocks
+func newTestBytePipe(blocks ...string) *BytePipe {
+	bp := NewBytePipe()
+	for _, s := range blocks {
+		bp.Append([]byte(s))
+	}
+	bp.Close()
+	return bp
+}
+
+func TestBytePipeReadByte(t *testing.T) {
+	bp := newTestBytePipe("ab", "", "c")
+	var got []byte
+	for {
+		c, err := bp.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+		if c == 'b' || c == 'c' {
+			// unread at the end of a block
+			if err := bp.UnreadByte(); err != nil {
+				t.Fatal(err)
+			}
+			if err := bp.UnreadByte(); err != bufio.ErrInvalidUnreadByte {
+				t.Errorf("second UnreadByte must fail, actual %v", err)
+			}
+			c2, _ := bp.ReadByte()
+			if c2 != c {
+				t.Errorf("unread byte mismatch; expected %c, actual %c", c, c2)
+			}
+		}
+	}
+	if string(got) != "abc" {
+		t.Errorf("read data mismatch: %q", got)
+	}
+	if bp.Buffered() != 0 || bp.BytesRead() != 3 {
+		t.Errorf("unexpected counts: buffered %d, read %d", bp.Buffered(), bp.BytesRead())
+	}
+
+	// UnreadByte after Read
+	bp = newTestBytePipe("hello", "world")
+	buf := make([]byte, 5)
+	io.ReadFull(bp, buf)
+	bp.UnreadByte()
+	rest, _ := io.ReadAll(bp)
+	if string(rest) != "oworld" {
+		t.Errorf("read data mismatch: %q", rest)
+	}
+}
+
+func TestBytePipeReadRune(t *testing.T) {
+	s := "a가나\xffé😀z"
+	// split the data at every byte
+	var blocks []string
+	for i := 0; i < len(s); i++ {
+		blocks = append(blocks, s[i:i+1])
+	}
+	for _, bp := range []*BytePipe{newTestBytePipe(s), newTestBytePipe(blocks...)} {
+		var got []rune
+		for {
+			r, size, err := bp.ReadRune()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r != utf8.RuneError && size != utf8.RuneLen(r) {
+				t.Errorf("rune size mismatch: %c, %d", r, size)
+			}
+			got = append(got, r)
+			if r == '나' {
+				if err := bp.UnreadRune(); err != nil {
+					t.Fatal(err)
+				}
+				if r2, _, _ := bp.ReadRune(); r2 != r {
+					t.Errorf("unread rune mismatch; expected %c, actual %c", r, r2)
+				}
+			}
+		}
+		if string(got) != strings.ToValidUTF8(s, "�") {
+			t.Errorf("read data mismatch: %q", string(got))
+		}
+	}
+
+	// an incomplete rune at the end
+	bp := newTestBytePipe("x\xe0", "\xa4")
+	bp.ReadRune()
+	r, size, err := bp.ReadRune()
+	if r != utf8.RuneError || size != 1 || err != nil {
+		t.Errorf("unexpected ReadRune result: %c, %d, %v", r, size, err)
+	}
+	if c, err := bp.ReadByte(); c != 0xa4 || err != nil {
+		t.Errorf("the rest of an incomplete rune must remain: %x, %v", c, err)
+	}
+	if err := bp.UnreadRune(); err != bufio.ErrInvalidUnreadRune {
+		t.Errorf("UnreadRune after ReadByte must fail, actual %v", err)
+	}
+}
+
+func TestBytePipeReadSlice(t *testing.T) {
+	bp := newTestBytePipe("line1\nli", "ne2\n", "line", "3\r", "\nlast")
+	for _, expected := range []string{"line1\n", "line2\n", "line3\r\n"} {
+		line, err := bp.ReadSlice('\n')
+		if err != nil || string(line) != expected {
+			t.Fatalf("unexpected ReadSlice result: %q, %v", line, err)
+		}
+	}
+	line, err := bp.ReadSlice('\n')
+	if err != io.EOF || string(line) != "last" {
+		t.Errorf("unexpected ReadSlice result: %q, %v", line, err)
+	}
+
+	bp = newTestBytePipe("a,b", "c,", ",d")
+	for _, expected := range []string{"a,", "bc,", ","} {
+		s, err := bp.ReadString(',')
+		if err != nil || s != expected {
+			t.Fatalf("unexpected ReadString result: %q, %v", s, err)
+		}
+	}
+	b, err := bp.ReadBytes(',')
+	if err != io.EOF || string(b) != "d" {
+		t.Errorf("unexpected ReadBytes result: %q, %v", b, err)
+	}
+
+	// ReadSlice waits for the delim
+	bp = NewBytePipe()
+	go func() {
+		for _, s := range []string{"wait", "ing", " for", " delim;"} {
+			time.Sleep(time.Millisecond)
+			bp.Write([]byte(s))
+		}
+	}()
+	line, err = bp.ReadSlice(';')
+	if err != nil || string(line) != "waiting for delim;" {
+		t.Errorf("unexpected ReadSlice result: %q, %v", line, err)
+	}
+
+	// MaxSliceSize
+	bp = newTestBytePipe("0123", "456789\n", "ab\n")
+	bp.MaxSliceSize = 4
+	line, err = bp.ReadSlice('\n')
+	if err != bufio.ErrBufferFull || string(line) != "0123" {
+		t.Errorf("unexpected ReadSlice result: %q, %v", line, err)
+	}
+	b, err = bp.ReadBytes('\n')
+	if err != nil || string(b) != "456789\n" {
+		t.Errorf("unexpected ReadBytes result: %q, %v", b, err)
+	}
+}
+
+func TestBytePipeUnreadAtEOF(t *testing.T) {
+	// reads returning nothing at the end keep the last byte, as bufio.Reader
+	type reader interface {
+		Read(p []byte) (int, error)
+		ReadByte() (byte, error)
+		ReadRune() (rune, int, error)
+		ReadBytes(delim byte) ([]byte, error)
+		UnreadByte() error
+		UnreadRune() error
+	}
+	ops := map[string]func(r reader){
+		"Read":      func(r reader) { r.Read(make([]byte, 4)) },
+		"ReadByte":  func(r reader) { r.ReadByte() },
+		"ReadRune":  func(r reader) { r.ReadRune() },
+		"ReadBytes": func(r reader) { r.ReadBytes('\n') },
+	}
+	for name, op := range ops {
+		for _, unreadRune := range []bool{false, true} {
+			var errs [2]error
+			for i, r := range []reader{bufio.NewReader(strings.NewReader("é")), newTestBytePipe("é")} {
+				r.ReadRune()
+				op(r)
+				if unreadRune {
+					errs[i] = r.UnreadRune()
+				} else {
+					errs[i] = r.UnreadByte()
+				}
+			}
+			if (errs[0] == nil) != (errs[1] == nil) {
+				t.Errorf("%s at EOF, unread rune %v: bufio %v, BytePipe %v", name, unreadRune, errs[0], errs[1])
+			}
+		}
+	}
+}
+
+func TestBytePipeReadLine(t *testing.T) {
+	bp := newTestBytePipe("first\r\nsec", "ond\n", "0123456\r", "\nlast")
+	bp.MaxSliceSize = 8
+	type result struct {
+		line     string
+		isPrefix bool
+	}
+	expected := []result{{"first", false}, {"second", false}, {"0123456", true}, {"", false}, {"last", false}}
+	for _, e := range expected {
+		line, isPrefix, err := bp.ReadLine()
+		if err != nil || string(line) != e.line || isPrefix != e.isPrefix {
+			t.Fatalf("unexpected ReadLine result: %q, %v, %v", line, isPrefix, err)
+		}
+	}
+	if line, _, err := bp.ReadLine(); err != io.EOF || line != nil {
+		t.Errorf("ReadLine at the end must return io.EOF, actual %q, %v", line, err)
+	}
+
+	// compare with bufio.Scanner
+	text := strings.Repeat("the quick brown fox\njumps over\r\n\nthe lazy dog\n", 100)
+	var blocks []string
+	for i := 0; i < len(text); i += 7 {
+		end := i + 7
+		if end > len(text) {
+			end = len(text)
+		}
+		blocks = append(blocks, text[i:end])
+	}
+	bp = newTestBytePipe(blocks...)
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		line, _, err := bp.ReadLine()
+		if err != nil || string(line) != sc.Text() {
+			t.Fatalf("ReadLine mismatch; expected %q, actual %q, %v", sc.Text(), line, err)
+		}
+	}
+}
+
+func TestBytePipePeek(t *testing.T) {
+	bp := newTestBytePipe("hello", " ", "world")
+	ctx := context.Background()
+
+	// within a block, no merge
+	p, err := bp.Peek(ctx, 3)
+	if err != nil || string(p) != "hel" {
+		t.Fatalf("unexpected Peek result: %q, %v", p, err)
+	}
+	if bp.Len() != 2 {
+		t.Errorf("Peek within a block must not take other blocks: %d", bp.Len())
+	}
+	// across blocks
+	p, err = bp.Peek(ctx, 8)
+	if err != nil || string(p) != "hello wo" {
+		t.Fatalf("unexpected Peek result: %q, %v", p, err)
+	}
+	if bp.Buffered() != 11 {
+		t.Errorf("Peek must not consume: %d", bp.Buffered())
+	}
+	buf := make([]byte, 2)
+	bp.Read(buf)
+	if string(buf) != "he" {
+		t.Errorf("read data mismatch: %q", buf)
+	}
+
+	// Discard and Fetch keep the order
+	if n, err := bp.Discard(4); n != 4 || err != nil {
+		t.Errorf("unexpected Discard result: %d, %v", n, err)
+	}
+	b, err := bp.Fetch()
+	if err != nil || string(b) != "world" {
+		t.Errorf("unexpected Fetch result: %q, %v", b, err)
+	}
+
+	// fewer bytes than requested at the end
+	bp = newTestBytePipe("ab", "c")
+	p, err = bp.Peek(ctx, 5)
+	if err != io.EOF || string(p) != "abc" {
+		t.Errorf("unexpected Peek result: %q, %v", p, err)
+	}
+	n, err := bp.Discard(5)
+	if n != 3 || err != io.EOF {
+		t.Errorf("unexpected Discard result: %d, %v", n, err)
+	}
+	if _, err := bp.Peek(ctx, -1); err != bufio.ErrNegativeCount {
+		t.Errorf("Peek with a negative count must fail, actual %v", err)
+	}
+
+	// Peek waits for the data, or the context
+	bp = NewBytePipe()
+	go func() {
+		for _, s := range []string{"\x16\x03", "\x01", "\x02\x00"} {
+			time.Sleep(time.Millisecond)
+			bp.Write([]byte(s))
+		}
+	}()
+	p, err = bp.Peek(ctx, 4)
+	if err != nil || string(p) != "\x16\x03\x01\x02" {
+		t.Fatalf("unexpected Peek result: %q, %v", p, err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	p, err = bp.Peek(tctx, 10)
+	cancel()
+	if err != context.DeadlineExceeded || len(p) != 5 {
+		t.Errorf("unexpected Peek result: %q, %v", p, err)
+	}
+	all := make([]byte, 5)
+	if _, err := io.ReadFull(bp, all); err != nil || string(all) != "\x16\x03\x01\x02\x00" {
+		t.Errorf("read data mismatch: %q, %v", all, err)
+	}
+
+	// pooled blocks are merged
+	bp = NewBytePipe()
+	bp.UsePool = true
+	for i := 0; i < 10; i++ {
+		bp.Write([]byte{byte('0' + i)})
+	}
+	bp.Close()
+	p, _ = bp.Peek(ctx, 10)
+	if string(p) != "0123456789" {
+		t.Errorf("unexpected Peek result: %q", p)
+	}
+	rest, _ := io.ReadAll(bp)
+	if string(rest) != "0123456789" {
+		t.Errorf("read data mismatch: %q", rest)
+	}
+}
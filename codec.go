@@ -0,0 +1,205 @@
+package bufpipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// A Codec converts between data of type T and a byte stream. See Encode() and Decode().
+type Codec[T any] interface {
+	NewEncoder(w io.Writer) Encoder[T]
+	NewDecoder(r io.Reader) Decoder[T]
+}
+
+// An Encoder writes data of type T to a byte stream.
+type Encoder[T any] interface {
+	Encode(v T) error
+}
+
+// A Decoder reads data of type T from a byte stream.
+// Decode() returns io.EOF at the end of the stream, and io.ErrUnexpectedEOF if the stream ends in the middle of a record.
+type Decoder[T any] interface {
+	Decode() (T, error)
+}
+
+// Encode each data received from src to w, until src is closed and drained.
+// n is the number of data encoded. Returns nil error at the io.EOF of src.
+// If src is closed with an error, then the error is returned.
+func Encode[T any](ctx context.Context, src *Pipe[T], w io.Writer, codec Codec[T]) (n int, err error) {
+	enc := codec.NewEncoder(w)
+	for {
+		var v T
+		v, err = src.Receive(ctx)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if err = enc.Encode(v); err != nil {
+			return
+		}
+		n++
+	}
+}
+
+// Decode data from r and append them to dst, until r ends.
+// n is the number of data appended. The function always closes dst when it returns:
+// with Close() at the end of r, or with CloseWithError() on a decode error, including io.ErrUnexpectedEOF of a partial record at the end.
+// The ctx is used while waiting for a free slot of a bounded dst, and its error also closes dst.
+func Decode[T any](ctx context.Context, r io.Reader, dst *Pipe[T], codec Codec[T]) (n int, err error) {
+	dec := codec.NewDecoder(r)
+	for {
+		var v T
+		v, err = dec.Decode()
+		if err == nil {
+			_, err = dst.AppendContext(ctx, v)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			dst.CloseWithError(err)
+			return
+		}
+		n++
+	}
+}
+
+// encoding/gob codec
+type gobCodec[T any] struct{}
+
+// A Codec of encoding/gob.
+func GobCodec[T any]() Codec[T] {
+	return gobCodec[T]{}
+}
+
+func (gobCodec[T]) NewEncoder(w io.Writer) Encoder[T] {
+	return gobEncoder[T]{gob.NewEncoder(w)}
+}
+
+func (gobCodec[T]) NewDecoder(r io.Reader) Decoder[T] {
+	return gobDecoder[T]{gob.NewDecoder(r)}
+}
+
+type gobEncoder[T any] struct{ enc *gob.Encoder }
+
+func (e gobEncoder[T]) Encode(v T) error {
+	return e.enc.Encode(v)
+}
+
+type gobDecoder[T any] struct{ dec *gob.Decoder }
+
+func (d gobDecoder[T]) Decode() (v T, err error) {
+	err = d.dec.Decode(&v)
+	return
+}
+
+// JSON Lines codec
+type jsonLinesCodec[T any] struct{}
+
+// A Codec of JSON Lines, where each data is a JSON value in a line.
+// Empty lines are skipped. The last line may omit the newline, but an incomplete JSON value there is io.ErrUnexpectedEOF.
+func JSONLinesCodec[T any]() Codec[T] {
+	return jsonLinesCodec[T]{}
+}
+
+func (jsonLinesCodec[T]) NewEncoder(w io.Writer) Encoder[T] {
+	// json.Encoder writes a newline after each value
+	return jsonEncoder[T]{json.NewEncoder(w)}
+}
+
+func (jsonLinesCodec[T]) NewDecoder(r io.Reader) Decoder[T] {
+	return &jsonLinesDecoder[T]{r: bufio.NewReader(r)}
+}
+
+type jsonEncoder[T any] struct{ enc *json.Encoder }
+
+func (e jsonEncoder[T]) Encode(v T) error {
+	return e.enc.Encode(v)
+}
+
+type jsonLinesDecoder[T any] struct{ r *bufio.Reader }
+
+func (d *jsonLinesDecoder[T]) Decode() (v T, err error) {
+	for {
+		var line []byte
+		line, err = d.r.ReadBytes('\n')
+		terminated := err == nil
+		if err != nil && err != io.EOF {
+			return
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			if terminated {
+				continue
+			}
+			return v, io.EOF
+		}
+		if e := json.Unmarshal(line, &v); e != nil {
+			if !terminated {
+				// a partial record at the end of the stream
+				e = io.ErrUnexpectedEOF
+			}
+			return v, e
+		}
+		return v, nil
+	}
+}
+
+// length-prefixed encoding.BinaryMarshaler codec
+type binaryCodec[T encoding.BinaryMarshaler, PT interface {
+	*T
+	encoding.BinaryUnmarshaler
+}] struct {
+	maxSize int
+}
+
+// A Codec of encoding.BinaryMarshaler, where each data is written as a frame of WriteFrame().
+// A record larger than maxSize, or DefaultMaxFrameSize if maxSize <= 0, is a *FrameSizeError on decoding.
+func BinaryCodec[T encoding.BinaryMarshaler, PT interface {
+	*T
+	encoding.BinaryUnmarshaler
+}](maxSize int) Codec[T] {
+	return binaryCodec[T, PT]{maxSize: maxSize}
+}
+
+func (c binaryCodec[T, PT]) NewEncoder(w io.Writer) Encoder[T] {
+	return binaryEncoder[T]{w}
+}
+
+func (c binaryCodec[T, PT]) NewDecoder(r io.Reader) Decoder[T] {
+	return binaryDecoder[T, PT]{r, c.maxSize}
+}
+
+type binaryEncoder[T encoding.BinaryMarshaler] struct{ w io.Writer }
+
+func (e binaryEncoder[T]) Encode(v T) error {
+	b, err := v.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return WriteFrame(e.w, b)
+}
+
+type binaryDecoder[T any, PT interface {
+	*T
+	encoding.BinaryUnmarshaler
+}] struct {
+	r       io.Reader
+	maxSize int
+}
+
+func (d binaryDecoder[T, PT]) Decode() (v T, err error) {
+	b, err := ReadFrame(d.r, d.maxSize)
+	if err != nil {
+		return
+	}
+	err = PT(&v).UnmarshalBinary(b)
+	return
+}
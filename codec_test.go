@@ -0,0 +1,114 @@
+package bufpipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRecord struct {
+	ID   int
+	Name string
+}
+
+func testCodecRoundTrip[T comparable](t *testing.T, codec Codec[T], data []T) []byte {
+	ctx := context.Background()
+	src := NewPipe[T]()
+	for _, v := range data {
+		src.Append(v)
+	}
+	src.Close()
+
+	// encode to a BytePipe, and decode back
+	bp := NewBytePipe()
+	n, err := Encode(ctx, src, bp, codec)
+	if err != nil || n != len(data) {
+		t.Fatalf("unexpected Encode result: %d, %v", n, err)
+	}
+	bp.Close()
+	var encoded bytes.Buffer
+	bp.WriteTo(&encoded)
+
+	dst := NewPipe[T]()
+	n, err = Decode(ctx, bytes.NewReader(encoded.Bytes()), dst, codec)
+	if err != nil || n != len(data) {
+		t.Fatalf("unexpected Decode result: %d, %v", n, err)
+	}
+	for _, expected := range data {
+		v, err := dst.Fetch()
+		if err != nil || v != expected {
+			t.Fatalf("decoded data mismatch; expected %v, actual %v, %v", expected, v, err)
+		}
+	}
+	if _, err := dst.Fetch(); err != io.EOF {
+		t.Errorf("Decode must close the destination, actual %v", err)
+	}
+
+	// a partial record at the end
+	dst = NewPipe[T]()
+	n, err = Decode(ctx, bytes.NewReader(encoded.Bytes()[:encoded.Len()-2]), dst, codec)
+	if err != io.ErrUnexpectedEOF || n != len(data)-1 {
+		t.Errorf("partial record must be detected, actual %d, %v", n, err)
+	}
+	for i := 0; i < n; i++ {
+		dst.Fetch()
+	}
+	if _, err := dst.Fetch(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode must close the destination with the error, actual %v", err)
+	}
+	return encoded.Bytes()
+}
+
+func TestCodecs(t *testing.T) {
+	records := []testRecord{{1, "one"}, {2, "two"}, {3, "three"}}
+	t.Run("gob", func(t *testing.T) {
+		testCodecRoundTrip(t, GobCodec[testRecord](), records)
+	})
+	t.Run("jsonlines", func(t *testing.T) {
+		b := testCodecRoundTrip(t, JSONLinesCodec[testRecord](), records)
+		if lines := strings.Count(string(b), "\n"); lines != len(records) {
+			t.Errorf("JSON Lines must have a line for each record: %q", b)
+		}
+
+		// empty lines, an unterminated last line, and a broken record
+		dst := NewPipe[testRecord]()
+		n, err := Decode(context.Background(), strings.NewReader("{\"ID\":1}\n\n{\"ID\":2}"), dst, JSONLinesCodec[testRecord]())
+		if n != 2 || err != nil {
+			t.Errorf("unexpected Decode result: %d, %v", n, err)
+		}
+		dst = NewPipe[testRecord]()
+		_, err = Decode(context.Background(), strings.NewReader("{\"ID\":1}\nbroken\n"), dst, JSONLinesCodec[testRecord]())
+		if err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("a broken record must be a decode error, actual %v", err)
+		}
+	})
+	t.Run("binary", func(t *testing.T) {
+		times := []time.Time{time.Unix(0, 0).UTC(), time.Unix(1600000000, 123).UTC(), time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC)}
+		testCodecRoundTrip(t, BinaryCodec[time.Time](0), times)
+
+		var buf bytes.Buffer
+		WriteFrame(&buf, make([]byte, 100))
+		dst := NewPipe[time.Time]()
+		_, err := Decode(context.Background(), &buf, dst, BinaryCodec[time.Time](50))
+		var sizeErr *FrameSizeError
+		if !errors.As(err, &sizeErr) {
+			t.Errorf("a large record must be a *FrameSizeError, actual %v", err)
+		}
+	})
+}
+
+func TestEncodeCloseError(t *testing.T) {
+	closeErr := errors.New("producer failed")
+	src := NewPipe[int]()
+	src.Append(1)
+	src.CloseWithError(closeErr)
+	var buf bytes.Buffer
+	n, err := Encode(context.Background(), src, &buf, JSONLinesCodec[int]())
+	if n != 1 || err != closeErr {
+		t.Errorf("Encode must return the close error, actual %d, %v", n, err)
+	}
+}
@@ -0,0 +1,102 @@
+package bufpipe
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// A buffered in-memory net.Conn backed by two BytePipes. See ConnPair().
+// Unlike net.Pipe(), Write() never blocks; the written data is buffered until the peer reads it.
+type Conn struct {
+	r, w *BytePipe // read side and write side
+
+	writeDeadline deadline
+	closed        int32
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// Address of a Conn.
+type connAddr struct{}
+
+func (connAddr) Network() string { return "bufpipe" }
+func (connAddr) String() string  { return "bufpipe" }
+
+// Create a pair of connected buffered in-memory net.Conn.
+// The data written to one side can be read from the other side.
+// Close() on one side makes the peer read io.EOF after the buffered data, and makes the peer's Write() fail.
+func ConnPair() (c1, c2 *Conn) {
+	a, b := NewBytePipe(), NewBytePipe()
+	return &Conn{r: a, w: b}, &Conn{r: b, w: a}
+}
+
+// Read data sent from the peer.
+// Returns io.EOF if the peer is closed and no data left, and io.ErrClosedPipe if the Conn is closed.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return c.r.Read(p)
+}
+
+// Write data to the peer. The function does not block.
+// Returns io.ErrClosedPipe if the Conn or the peer is closed.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return 0, io.ErrClosedPipe
+	}
+	if c.writeDeadline.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.w.Write(p)
+}
+
+// Close the connection.
+// Blocked Read() calls are released, and the peer reads io.EOF after the buffered data.
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	c.r.CloseRead(nil)
+	c.w.Close()
+	return nil
+}
+
+// Shut down the writing side of the connection, like net.TCPConn.CloseWrite().
+// The peer reads io.EOF after the buffered data, but the Conn is still readable.
+func (c *Conn) CloseWrite() error {
+	c.w.Close()
+	return nil
+}
+
+// LocalAddr returns a placeholder address.
+func (c *Conn) LocalAddr() net.Addr {
+	return connAddr{}
+}
+
+// RemoteAddr returns a placeholder address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return connAddr{}
+}
+
+// Set both the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// Set the read deadline. Blocked Read() calls are released with os.ErrDeadlineExceeded when the deadline is exceeded.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+// Set the write deadline.
+// Since Write() never blocks, the deadline only makes Write() fail after it is exceeded.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
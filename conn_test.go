@@ -0,0 +1,256 @@
+package bufpipe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// conformance tests in the manner of golang.org/x/net/nettest.TestConn
+func TestConnPair(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, c1, c2 net.Conn)
+	}{
+		{"BasicIO", testConnBasicIO},
+		{"PingPong", testConnPingPong},
+		{"WriteBeforeRead", testConnWriteBeforeRead},
+		{"PastTimeout", testConnPastTimeout},
+		{"FutureTimeout", testConnFutureTimeout},
+		{"CloseTimeout", testConnCloseTimeout},
+		{"Close", testConnClose},
+		{"CloseWrite", testConnCloseWrite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := ConnPair()
+			defer c1.Close()
+			defer c2.Close()
+			tt.fn(t, c1, c2)
+		})
+	}
+}
+
+// write random data to c1, and read it back from c2 through an echo
+func testConnBasicIO(t *testing.T, c1, c2 net.Conn) {
+	want := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(want)
+
+	// echo on c2
+	go func() {
+		io.Copy(c2, c2)
+		c2.Close()
+	}()
+
+	dataCh := make(chan []byte)
+	go func() {
+		rd := bytes.NewReader(want)
+		if err := chunkedCopy(c1, rd); err != nil {
+			t.Errorf("unexpected c1.Write error: %v", err)
+		}
+		if err := c1.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+			t.Errorf("unexpected c1.CloseWrite error: %v", err)
+		}
+	}()
+	go func() {
+		wr := new(bytes.Buffer)
+		if err := chunkedCopy(wr, c1); err != nil {
+			t.Errorf("unexpected c1.Read error: %v", err)
+		}
+		dataCh <- wr.Bytes()
+	}()
+
+	if got := <-dataCh; !bytes.Equal(got, want) {
+		t.Errorf("transmitted data differs")
+	}
+}
+
+// copy data in random sized chunks
+func chunkedCopy(w io.Writer, r io.Reader) error {
+	b := make([]byte, 1024)
+	for {
+		n, err := r.Read(b[:1+rand.Intn(len(b))])
+		if n > 0 {
+			if _, werr := w.Write(b[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func testConnPingPong(t *testing.T, c1, c2 net.Conn) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pingPonger := func(c net.Conn) {
+		defer wg.Done()
+		buf := make([]byte, 8)
+		var prev uint64
+		for {
+			if _, err := io.ReadFull(c, buf); err != nil {
+				if err == io.EOF {
+					break
+				}
+				t.Errorf("unexpected Read error: %v", err)
+			}
+			v := uint64(buf[0]) | uint64(buf[1])<<8
+			if prev != 0 && prev+2 != v {
+				t.Errorf("mismatching value: got %d, want %d", v, prev+2)
+			}
+			prev = v
+			v++
+			buf[0], buf[1] = byte(v), byte(v>>8)
+			if v == 1000 {
+				c.Close()
+				break
+			}
+			if _, err := c.Write(buf); err != nil {
+				t.Errorf("unexpected Write error: %v", err)
+				break
+			}
+		}
+	}
+
+	wg.Add(2)
+	go pingPonger(c1)
+	go pingPonger(c2)
+
+	// start off the chain reaction
+	if _, err := c1.Write(make([]byte, 8)); err != nil {
+		t.Errorf("unexpected c1.Write error: %v", err)
+	}
+}
+
+// both sides write before reading, which deadlocks on net.Pipe()
+func testConnWriteBeforeRead(t *testing.T, c1, c2 net.Conn) {
+	msg := bytes.Repeat([]byte("x"), 1<<16)
+	for _, c := range []net.Conn{c1, c2} {
+		if _, err := c.Write(msg); err != nil {
+			t.Fatalf("unexpected Write error: %v", err)
+		}
+	}
+	for _, c := range []net.Conn{c1, c2} {
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil || !bytes.Equal(buf, msg) {
+			t.Fatalf("unexpected Read result: %v", err)
+		}
+	}
+}
+
+func checkTimeout(t *testing.T, err error) {
+	t.Helper()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want timeout error", err)
+	}
+}
+
+func testConnPastTimeout(t *testing.T, c1, c2 net.Conn) {
+	c1.Write([]byte("data"))
+	c2.SetDeadline(time.Now().Add(-time.Second))
+	_, err := c2.Read(make([]byte, 1024))
+	checkTimeout(t, err)
+	_, err = c2.Write([]byte("data"))
+	checkTimeout(t, err)
+
+	// the deadline can be cleared
+	c2.SetDeadline(time.Time{})
+	if n, err := c2.Read(make([]byte, 1024)); err != nil || n != 4 {
+		t.Errorf("unexpected Read result: %d, %v", n, err)
+	}
+}
+
+func testConnFutureTimeout(t *testing.T, c1, c2 net.Conn) {
+	c1.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := c1.Read(make([]byte, 1024))
+		checkTimeout(t, err)
+	}()
+	go func() {
+		defer wg.Done()
+		// writes do not block, so they succeed before the deadline
+		if _, err := c1.Write([]byte("data")); err != nil {
+			t.Errorf("unexpected Write error: %v", err)
+		}
+	}()
+	wg.Wait()
+	time.Sleep(60 * time.Millisecond)
+	_, err := c1.Write([]byte("data"))
+	checkTimeout(t, err)
+}
+
+// Close() must release a blocked Read()
+func testConnCloseTimeout(t *testing.T, c1, c2 net.Conn) {
+	done := make(chan error)
+	go func() {
+		_, err := c1.Read(make([]byte, 1024))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c1.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Read on a closed Conn must fail")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Read is not released by Close")
+	}
+}
+
+func testConnClose(t *testing.T, c1, c2 net.Conn) {
+	c1.Write([]byte("bye"))
+	c1.Close()
+
+	// local operations fail
+	if _, err := c1.Read(make([]byte, 16)); err != io.ErrClosedPipe {
+		t.Errorf("Read on a closed Conn must return io.ErrClosedPipe, actual %v", err)
+	}
+	if _, err := c1.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write on a closed Conn must return io.ErrClosedPipe, actual %v", err)
+	}
+
+	// the peer reads the buffered data and io.EOF
+	b, err := io.ReadAll(c2)
+	if err != nil || string(b) != "bye" {
+		t.Errorf("unexpected ReadAll result: %q, %v", b, err)
+	}
+	if _, err := c2.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write to a closed peer must return io.ErrClosedPipe, actual %v", err)
+	}
+}
+
+func testConnCloseWrite(t *testing.T, c1, c2 net.Conn) {
+	c1.Write([]byte("request"))
+	c1.(interface{ CloseWrite() error }).CloseWrite()
+	if _, err := c1.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write after CloseWrite must return io.ErrClosedPipe, actual %v", err)
+	}
+
+	b, err := io.ReadAll(c2)
+	if err != nil || string(b) != "request" {
+		t.Errorf("unexpected ReadAll result: %q, %v", b, err)
+	}
+	// half-closed Conn is still readable
+	c2.Write([]byte("response"))
+	c2.Close()
+	b, err = io.ReadAll(c1)
+	if err != nil || string(b) != "response" {
+		t.Errorf("unexpected ReadAll result: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,75 @@
+package bufpipe
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A deadline that can be changed at any time, for SetReadDeadline() and alike.
+// The channel returned by wait() is closed when the deadline is exceeded.
+// Changing the deadline while a goroutine is waiting on the channel works as expected,
+// since the channel is replaced only after it is closed.
+type deadline struct {
+	mu     sync.Mutex
+	armed  int32 // set once a deadline is given; read without the lock for the fast path
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline is exceeded
+}
+
+// set the deadline. A zero value for t means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to close the channel
+	}
+	d.timer = nil
+
+	closed := d.cancel != nil && isClosedChan(d.cancel)
+	if d.cancel == nil || closed {
+		d.cancel = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	atomic.StoreInt32(&d.armed, 1)
+
+	if dur := time.Until(t); dur > 0 {
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	// the deadline is in the past
+	close(d.cancel)
+}
+
+// get a channel that is closed when the deadline is exceeded
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cancel == nil {
+		d.cancel = make(chan struct{})
+	}
+	return d.cancel
+}
+
+// check if the deadline is exceeded
+func (d *deadline) expired() bool {
+	if atomic.LoadInt32(&d.armed) == 0 {
+		return false
+	}
+	return isClosedChan(d.wait())
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,99 @@
+package bufpipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPipeReadDeadline(t *testing.T) {
+	q := NewPipe[int]()
+
+	// a deadline in the past
+	q.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := q.Receive(context.Background()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Receive must return os.ErrDeadlineExceeded, actual %v", err)
+	}
+
+	// clear the deadline
+	q.SetReadDeadline(time.Time{})
+	q.Append(1)
+	if n, err := q.Receive(context.Background()); err != nil || n != 1 {
+		t.Errorf("invalid receive; must return 1, actual %d (error %v)", n, err)
+	}
+
+	// a deadline in the future
+	q.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := q.Receive(context.Background())
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Receive must return os.ErrDeadlineExceeded, actual %v", err)
+	}
+	var ne interface{ Timeout() bool }
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("deadline error must be a timeout: %v", err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("Receive returned too early: %v", d)
+	}
+
+	// changing the deadline wakes a blocked Receive()
+	q.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := q.Receive(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.SetReadDeadline(time.Now().Add(time.Hour)) // extended; still blocked
+	select {
+	case err := <-done:
+		t.Fatalf("Receive must be blocked, returned %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.SetReadDeadline(time.Now())
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Receive must return os.ErrDeadlineExceeded, actual %v", err)
+	}
+
+	// ReceiveTimeout
+	q.SetReadDeadline(time.Time{})
+	if _, err := q.ReceiveTimeout(time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReceiveTimeout must return os.ErrDeadlineExceeded, actual %v", err)
+	}
+	q.Append(2)
+	if n, err := q.ReceiveTimeout(time.Millisecond); err != nil || n != 2 {
+		t.Errorf("invalid receive; must return 2, actual %d (error %v)", n, err)
+	}
+}
+
+func TestBytePipeReadDeadline(t *testing.T) {
+	bp := NewBytePipe()
+	buf := make([]byte, 16)
+
+	bp.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := bp.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read must return os.ErrDeadlineExceeded, actual %v", err)
+	}
+	bp.SetReadDeadline(time.Time{})
+
+	// ReadContext
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err := bp.ReadContext(ctx, buf)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("ReadContext must return context error, actual %v", err)
+	}
+	bp.Write([]byte("hello"))
+	bp.Close()
+	n, err := bp.ReadContext(context.Background(), buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("invalid read: %q, %v", buf[:n], err)
+	}
+	if _, err := bp.ReadContext(context.Background(), buf); err != io.EOF {
+		t.Errorf("ReadContext must return io.EOF, actual %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package bufpipe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Size of the length prefix of a frame.
+const FrameHeaderSize = 4
+
+var DefaultMaxFrameSize = 16 * 1024 * 1024 // max size of a frame read by ReadFrame() with maxSize <= 0
+
+// frames larger than this are read in increments, not to allocate a whole frame for a broken header
+const frameReadChunk = 64 * 1024
+
+// A frame larger than the limit is written or read.
+type FrameSizeError struct {
+	Size uint64 // size of the frame
+	Max  uint64 // max size of a frame
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("frame size %d exceeds the limit %d", e.Size, e.Max)
+}
+
+// Read a message, which is exactly one data block written by WriteMessage() or Append().
+// If a block is partially read by Read() or alike, then the rest of the block is returned as a message.
+// Note that the writes merged by CoalesceSize, and the blocks created by ReadFrom(), do not keep the message boundaries.
+// The function blocks as Receive(), and returns io.EOF, or the close error, at the end of the stream.
+func (bp *BytePipe) ReadMessage(ctx context.Context) (p []byte, err error) {
+	return bp.Receive(ctx)
+}
+
+// Write p as a message, which is read by a ReadMessage() as a whole.
+// The data is copied, and never merged with other writes.
+func (bp *BytePipe) WriteMessage(p []byte) (err error) {
+	// keep the order with the coalescing writes
+	if err = bp.Flush(); err != nil {
+		return
+	}
+	data := bp.alloc(len(p))
+	copy(data, p)
+	if _, err = bp.Append(data); err != nil {
+		bp.recycle(data)
+	}
+	return
+}
+
+// Write p to w as a frame, prefixed with the length in 32-bit big endian.
+// Returns a *FrameSizeError if p is too large for a frame.
+func WriteFrame(w io.Writer, p []byte) (err error) {
+	if uint64(len(p)) > math.MaxUint32 {
+		return &FrameSizeError{Size: uint64(len(p)), Max: math.MaxUint32}
+	}
+	var hdr [FrameHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+	if _, err = w.Write(hdr[:]); err != nil {
+		return
+	}
+	_, err = w.Write(p)
+	return
+}
+
+// Read a frame written by WriteFrame().
+// A frame larger than maxSize, or DefaultMaxFrameSize if maxSize <= 0, is not read and a *FrameSizeError is returned.
+// The buffer of a large frame grows as the data arrives, so a broken header does not allocate the whole size at once.
+// Returns io.EOF if r ends at a frame boundary, and io.ErrUnexpectedEOF if r ends in the middle of a frame.
+func ReadFrame(r io.Reader, maxSize int) (p []byte, err error) {
+	var hdr [FrameHeaderSize]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	size := int64(binary.BigEndian.Uint32(hdr[:]))
+	max := int64(maxSize)
+	if max <= 0 {
+		max = int64(DefaultMaxFrameSize)
+	}
+	if size > max {
+		return nil, &FrameSizeError{Size: uint64(size), Max: uint64(max)}
+	}
+	if size <= frameReadChunk {
+		p = make([]byte, size)
+		_, err = io.ReadFull(r, p)
+	} else {
+		var buf bytes.Buffer
+		buf.Grow(frameReadChunk)
+		_, err = io.CopyN(&buf, r, size)
+		p = buf.Bytes()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		p = nil
+	}
+	return
+}
+
+// Write each data block received from src to w as a frame, until src is closed and drained.
+// n is the number of frames written. Returns nil error at the io.EOF of src.
+func WriteFrames(ctx context.Context, w io.Writer, src *Pipe[[]byte]) (n int, err error) {
+	for {
+		var p []byte
+		p, err = src.Receive(ctx)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if err = WriteFrame(w, p); err != nil {
+			return
+		}
+		n++
+	}
+}
+
+// Read frames from r and append each of them to dst as a data block, until r ends.
+// maxSize is the limit of a frame as ReadFrame().
+// n is the number of frames appended. Returns nil error if r ends at a frame boundary.
+// The ctx is used while waiting for a free slot of a bounded dst. dst is not closed by the function.
+func ReadFrames(ctx context.Context, r io.Reader, dst *Pipe[[]byte], maxSize int) (n int, err error) {
+	for {
+		var p []byte
+		p, err = ReadFrame(r, maxSize)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if _, err = dst.AppendContext(ctx, p); err != nil {
+			return
+		}
+		n++
+	}
+}
@@ -0,0 +1,114 @@
+package bufpipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestBytePipeMessage(t *testing.T) {
+	ctx := context.Background()
+	bp := NewBytePipe()
+	bp.CoalesceSize = 64
+	bp.Write([]byte("merged "))
+	bp.Write([]byte("writes"))
+	for _, s := range []string{"first", "", "second"} {
+		if err := bp.WriteMessage([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bp.Close()
+	for _, s := range []string{"merged writes", "first", ""} {
+		p, err := bp.ReadMessage(ctx)
+		if err != nil || string(p) != s {
+			t.Fatalf("unexpected ReadMessage result: %q, %v", p, err)
+		}
+	}
+	// the rest of a partially read message
+	buf := make([]byte, 2)
+	bp.Read(buf)
+	p, err := bp.ReadMessage(ctx)
+	if err != nil || string(p) != "cond" {
+		t.Errorf("unexpected ReadMessage result: %q, %v", p, err)
+	}
+	if _, err = bp.ReadMessage(ctx); err != io.EOF {
+		t.Errorf("ReadMessage at the end must return io.EOF, actual %v", err)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	ctx := context.Background()
+	src := NewPipe[[]byte]()
+	msgs := []string{"hello", "", "frame", string(bytes.Repeat([]byte{'x'}, 1000))}
+	for _, s := range msgs {
+		src.Append([]byte(s))
+	}
+	src.Close()
+
+	// serialize over a BytePipe, and parse back
+	bp := NewBytePipe()
+	n, err := WriteFrames(ctx, bp, src)
+	if err != nil || n != len(msgs) {
+		t.Fatalf("unexpected WriteFrames result: %d, %v", n, err)
+	}
+	bp.Close()
+	dst := NewPipe[[]byte]()
+	n, err = ReadFrames(ctx, bp, dst, 0)
+	if err != nil || n != len(msgs) {
+		t.Fatalf("unexpected ReadFrames result: %d, %v", n, err)
+	}
+	for _, s := range msgs {
+		p, err := dst.Fetch()
+		if err != nil || string(p) != s {
+			t.Fatalf("unexpected frame: %q, %v", p, err)
+		}
+	}
+
+	// max frame size
+	var buf bytes.Buffer
+	WriteFrame(&buf, []byte("small"))
+	WriteFrame(&buf, []byte("too large"))
+	dst = NewPipe[[]byte]()
+	n, err = ReadFrames(ctx, &buf, dst, 8)
+	var sizeErr *FrameSizeError
+	if n != 1 || !errors.As(err, &sizeErr) || sizeErr.Size != 9 || sizeErr.Max != 8 {
+		t.Errorf("unexpected ReadFrames result: %d, %v", n, err)
+	}
+
+	// the default max frame size for maxSize <= 0
+	hdr := []byte{0xff, 0xff, 0xff, 0xff}
+	_, err = ReadFrame(bytes.NewReader(hdr), 0)
+	if !errors.As(err, &sizeErr) || sizeErr.Size != math.MaxUint32 || sizeErr.Max != uint64(DefaultMaxFrameSize) {
+		t.Errorf("unexpected ReadFrame result: %v", err)
+	}
+
+	// a large frame is read in increments
+	large := bytes.Repeat([]byte("0123456789"), frameReadChunk/2)
+	buf.Reset()
+	WriteFrame(&buf, large)
+	if p, err := ReadFrame(&buf, 0); err != nil || !bytes.Equal(p, large) {
+		t.Errorf("unexpected large frame: %d, %v", len(p), err)
+	}
+	buf.Reset()
+	WriteFrame(&buf, large)
+	if _, err = ReadFrame(bytes.NewReader(buf.Bytes()[:frameReadChunk*2]), 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated large frame must return io.ErrUnexpectedEOF, actual %v", err)
+	}
+
+	// truncated frames
+	buf.Reset()
+	WriteFrame(&buf, []byte("truncated"))
+	b := buf.Bytes()
+	for _, l := range []int{2, FrameHeaderSize + 3} {
+		_, err = ReadFrame(bytes.NewReader(b[:l]), 0)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated frame must return io.ErrUnexpectedEOF, actual %v", err)
+		}
+	}
+	if _, err = ReadFrame(bytes.NewReader(nil), 0); err != io.EOF {
+		t.Errorf("empty input must return io.EOF, actual %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package bufpipe
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// max number of data read from a source at once, before serving other sources
+const mergeBatchSize = 64
+
+// Merger reads data from multiple source pipes and appends them to a single output pipe.
+// The sources can be added and removed while merging.
+// All sources are served by a single goroutine that waits on the notification channels of the sources.
+//
+// The output is closed when all sources have reached io.EOF or have been removed.
+// If a source is closed with an error, the output is closed with the first such error at once.
+// If the context is done, the output is closed with the context error.
+type Merger[T any] struct {
+	out *Pipe[T]
+
+	mu   sync.Mutex
+	ops  []mergeOp[T] // pending Add() and Remove()
+	done bool
+	kick chan struct{} // wakes the merging goroutine for the pending ops; buffered by 1
+}
+
+// a pending Add() or Remove()
+type mergeOp[T any] struct {
+	src    *Pipe[T]
+	remove bool
+	done   chan struct{} // closed when applied; nil for the initial sources
+}
+
+// a source being merged
+type mergeSource[T any] struct {
+	p *Pipe[T]
+	w *waiter[T] // registered in p.readers while waiting for a data
+
+	// used by MergeSorted()
+	head T    // the first data of the source, not merged yet
+	has  bool // head is valid
+	idle bool // the source is skipped by the watermark timeout until a data arrives
+}
+
+// Merge the source pipes into a new pipe.
+// The output is closed after all sources have reached io.EOF; see Merger for the details.
+func Merge[T any](ctx context.Context, srcs ...*Pipe[T]) *Pipe[T] {
+	return NewMerger(ctx, srcs...).Output()
+}
+
+// Start merging the source pipes into a new pipe.
+// If no source is given, the output is kept open until a source is added by Add() and reaches io.EOF.
+func NewMerger[T any](ctx context.Context, srcs ...*Pipe[T]) *Merger[T] {
+	m := &Merger[T]{
+		out:  NewPipe[T](),
+		kick: make(chan struct{}, 1),
+	}
+	for _, src := range srcs {
+		m.ops = append(m.ops, mergeOp[T]{src: src})
+	}
+	go m.run(ctx)
+	return m
+}
+
+// The output pipe.
+func (m *Merger[T]) Output() *Pipe[T] {
+	return m.out
+}
+
+// Add a source pipe. Adding a source already being merged has no effect.
+// Returns io.ErrClosedPipe if the merging is finished.
+func (m *Merger[T]) Add(src *Pipe[T]) error {
+	return m.apply(mergeOp[T]{src: src})
+}
+
+// Remove a source pipe. After the function returns, src is no longer read, and the remaining data are left in src.
+// Returns io.ErrClosedPipe if the merging is finished.
+func (m *Merger[T]) Remove(src *Pipe[T]) error {
+	return m.apply(mergeOp[T]{src: src, remove: true})
+}
+
+// pass an op to the merging goroutine, and wait until it is applied
+func (m *Merger[T]) apply(op mergeOp[T]) error {
+	op.done = make(chan struct{})
+	m.mu.Lock()
+	if m.done {
+		m.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	m.ops = append(m.ops, op)
+	m.mu.Unlock()
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+	<-op.done
+	return nil
+}
+
+// the merging goroutine
+func (m *Merger[T]) run(ctx context.Context) {
+	var (
+		srcs  []*mergeSource[T]
+		added bool // set when any source is added
+		sel   sourceSelect[T]
+	)
+
+	// stop merging; the data handed over to the waiters are passed to the output
+	stop := func(err error) {
+		m.mu.Lock()
+		m.done = true
+		ops := m.ops
+		m.ops = nil
+		m.mu.Unlock()
+		for _, op := range ops {
+			if op.done != nil {
+				close(op.done)
+			}
+		}
+		for _, s := range srcs {
+			m.unwait(s)
+		}
+		m.out.CloseWithError(err)
+	}
+
+	for {
+		// apply pending ops
+		m.mu.Lock()
+		ops := m.ops
+		m.ops = nil
+		m.mu.Unlock()
+		for _, op := range ops {
+			i := 0
+			for i < len(srcs) && srcs[i].p != op.src {
+				i++
+			}
+			if op.remove {
+				if i < len(srcs) {
+					m.unwait(srcs[i])
+					srcs = append(srcs[:i], srcs[i+1:]...)
+				}
+			} else if i == len(srcs) {
+				srcs = append(srcs, &mergeSource[T]{p: op.src})
+				added = true
+			}
+			if op.done != nil {
+				close(op.done)
+			}
+		}
+
+		// read the sources not waiting
+		busy := false
+		for i := 0; i < len(srcs); i++ {
+			s := srcs[i]
+			if s.w != nil {
+				continue
+			}
+			var err error
+			n := 0
+			for ; n < mergeBatchSize; n++ {
+				var v T
+				v, err = s.p.Fetch()
+				if err != nil {
+					break
+				}
+				if _, err = m.out.AppendContext(ctx, v); err != nil {
+					stop(err)
+					return
+				}
+			}
+			switch {
+			case err == io.EOF:
+				srcs = append(srcs[:i], srcs[i+1:]...)
+				i--
+			case err != nil && err != ErrNoData:
+				stop(err)
+				return
+			case n == mergeBatchSize:
+				busy = true
+			default:
+				if !s.wait() {
+					busy = true
+				}
+			}
+		}
+		if added && len(srcs) == 0 {
+			stop(nil)
+			return
+		}
+
+		// wait for the sources
+		i, s, closed := sel.wait(srcs, busy, ctx.Done(), m.kick)
+		switch {
+		case s != nil:
+			var v T
+			var ok bool
+			if closed {
+				v, ok = s.unwait()
+			} else {
+				v, ok = s.woken()
+			}
+			if ok {
+				if _, err := m.out.AppendContext(ctx, v); err != nil {
+					stop(err)
+					return
+				}
+			}
+		case i == 0: // context error
+			stop(contextErr(ctx))
+			return
+		case i == 1: // pending ops
+		default: // busy
+			runtime.Gosched()
+		}
+	}
+}
+
+// cancel the waiter of a source, and pass the data handed over to the waiter to the output
+func (m *Merger[T]) unwait(s *mergeSource[T]) (err error) {
+	v, ok := s.unwait()
+	if ok {
+		_, err = m.out.TryAppend(v)
+	}
+	return
+}
+
+// the error of a done context
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return context.Canceled
+}
+
+// register a waiter to the source.
+// Returns false if a data is available, or the pipe is closed and no Append() is running, and no waiter is registered.
+func (s *mergeSource[T]) wait() bool {
+	s.w = s.p.addReader()
+	return s.w != nil
+}
+
+// cancel the waiter of the source. ok is true if a data is handed over to the waiter.
+func (s *mergeSource[T]) unwait() (v T, ok bool) {
+	if s.w == nil {
+		return
+	}
+	v, ok = s.p.readers.cancel(s.w)
+	s.p.readers.recycle(s.w)
+	s.w = nil
+	return
+}
+
+// release the waiter of the source woken by Append(). ok is true if a data is handed over to the waiter.
+func (s *mergeSource[T]) woken() (v T, ok bool) {
+	w := s.w
+	s.w = nil
+	if w.handed {
+		v, ok = w.take(), true
+	}
+	s.p.readers.recycle(w)
+	return
+}
+
+// buffers for waiting on the sources with reflect.Select()
+type sourceSelect[T any] struct {
+	cases  []reflect.SelectCase
+	lookup []*mergeSource[T] // source for each pair of cases after chans
+}
+
+// wait until a channel in chans is received, or a waiting source is woken or closed and no Append() is running.
+// Returns the index of the received channel, or the source with closed flag.
+// If poll is set, then the function does not block and returns len(chans) if nothing is ready.
+func (ss *sourceSelect[T]) wait(srcs []*mergeSource[T], poll bool, chans ...any) (i int, s *mergeSource[T], closed bool) {
+	ss.cases = ss.cases[:0]
+	for _, ch := range chans {
+		ss.cases = append(ss.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+	}
+	ss.lookup = ss.lookup[:0]
+	for _, s := range srcs {
+		if s.w != nil {
+			ss.cases = append(ss.cases,
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.w.ch)},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.p.writeDoneCh)},
+			)
+			ss.lookup = append(ss.lookup, s)
+		}
+	}
+	if poll {
+		ss.cases = append(ss.cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	}
+	i, _, _ = reflect.Select(ss.cases)
+	n := i - len(chans)
+	if n >= 0 && n < 2*len(ss.lookup) {
+		// the wakeup token is consumed by the select, if woken
+		s, closed = ss.lookup[n/2], n%2 == 1
+		i = -1
+	} else if n >= 0 {
+		i = len(chans)
+	}
+	for j := range ss.cases {
+		ss.cases[j] = reflect.SelectCase{}
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package bufpipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	const nsrc, count = 20, 1000
+	srcs := make([]*Pipe[int], nsrc)
+	for i := range srcs {
+		srcs[i] = NewPipe[int]()
+	}
+	out := Merge(context.Background(), srcs...)
+
+	var wg sync.WaitGroup
+	for i, src := range srcs {
+		wg.Add(1)
+		go func(i int, src *Pipe[int]) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				src.Append(i*count + j)
+			}
+			src.Close()
+		}(i, src)
+	}
+
+	// the data from each source must be in order
+	last := make([]int, nsrc)
+	for i := range last {
+		last[i] = -1
+	}
+	total := 0
+	for {
+		v, err := out.Receive(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, j := v/count, v%count
+		if j != last[i]+1 {
+			t.Fatalf("unexpected data order of source %d: %d after %d", i, j, last[i])
+		}
+		last[i] = j
+		total++
+	}
+	wg.Wait()
+	if total != nsrc*count {
+		t.Errorf("unexpected number of data: %d", total)
+	}
+}
+
+func TestMergeError(t *testing.T) {
+	s1, s2 := NewPipe[int](), NewPipe[int]()
+	out := Merge(context.Background(), s1, s2)
+	s1.Append(1)
+	s1.Close()
+	errTest := errors.New("test")
+	s2.CloseWithError(errTest)
+	for {
+		_, err := out.Receive(context.Background())
+		if err == nil {
+			continue
+		}
+		if err != errTest {
+			t.Errorf("the error of a source must be propagated, actual %v", err)
+		}
+		break
+	}
+
+	// context error
+	ctx, cancel := context.WithCancel(context.Background())
+	out = Merge(ctx, NewPipe[int]())
+	cancel()
+	if _, err := out.ReceiveTimeout(time.Second); err != context.Canceled {
+		t.Errorf("the context error must be propagated, actual %v", err)
+	}
+}
+
+func TestMergerAddRemove(t *testing.T) {
+	m := NewMerger[int](context.Background())
+	out := m.Output()
+	if _, err := out.ReceiveTimeout(10 * time.Millisecond); err == io.EOF {
+		t.Errorf("a merger without sources must not be closed")
+	}
+
+	s1, s2 := NewPipe[int](), NewPipe[int]()
+	m.Add(s1)
+	s1.Append(1)
+	if v, err := out.ReceiveTimeout(time.Second); v != 1 || err != nil {
+		t.Errorf("unexpected receive result: %d, %v", v, err)
+	}
+	m.Add(s2)
+	m.Remove(s1)
+	s2.Append(2)
+	if v, err := out.ReceiveTimeout(time.Second); v != 2 || err != nil {
+		t.Errorf("unexpected receive result: %d, %v", v, err)
+	}
+	s1.Append(3)
+	if _, err := out.ReceiveTimeout(10 * time.Millisecond); err == nil {
+		t.Errorf("a removed source must not be read")
+	}
+	if s1.Len() != 1 {
+		t.Errorf("the data of a removed source must be left: %d", s1.Len())
+	}
+
+	// the output is closed when the last source reaches EOF
+	s2.Close()
+	if _, err := out.ReceiveTimeout(time.Second); err != io.EOF {
+		t.Errorf("unexpected receive result: %v", err)
+	}
+	if err := m.Add(s1); err != io.ErrClosedPipe {
+		t.Errorf("Add on a finished merger must return io.ErrClosedPipe, actual %v", err)
+	}
+}
@@ -29,7 +29,7 @@ func NewNotifyCh[T any]() *NotifyCh[T] {
 // The function returns nil if the channel is already fetched or notified.
 // If the user does NOT consumed the returned channel for some reason, then the channel should be reverted to unreferenced state using UnfetchChannel().
 func (c *NotifyCh[T]) FetchChannel() chan any {
-	if c.flagReceive == 0 {
+	if atomic.LoadInt32(&c.flagReceive) == 0 {
 		if atomic.CompareAndSwapInt32(&c.flagReceive, 0, 1) {
 			return c.ch
 		}
@@ -49,7 +49,7 @@ func (c *NotifyCh[T]) UnfetchChannel(ch chan any) bool {
 
 // fetch send-side channel
 func (c *NotifyCh[T]) fetchSendChannel() chan any {
-	if c.flagSend == 0 {
+	if atomic.LoadInt32(&c.flagSend) == 0 {
 		if atomic.CompareAndSwapInt32(&c.flagSend, 0, 1) {
 			return c.ch
 		}
@@ -1,5 +1,5 @@
 /*
-Package bufpipe implements several buffered pipe types of infinite size.
+Package bufpipe implements several buffered pipe types of infinite or bounded size.
 */
 package bufpipe
 
@@ -7,78 +7,407 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"runtime"
 	"sync/atomic"
+	"time"
 )
 
 var (
-	ErrNoData = fmt.Errorf("no data") // No data in the Pipe[T]
+	ErrNoData = fmt.Errorf("no data")      // No data in the Pipe[T]
+	ErrFull   = fmt.Errorf("pipe is full") // No free slot in a bounded Pipe[T]
 )
 
+// Policy on appending a data to a full bounded pipe.
+type OverflowPolicy int
+
+const (
+	Block      OverflowPolicy = iota // Append() blocks until a slot is freed. TryAppend() returns ErrFull.
+	DropOldest                       // The oldest data in the pipe is dropped to make a room for the new data.
+	DropNewest                       // The new data is dropped silently.
+	Reject                           // Append() returns ErrFull without blocking.
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "Block"
+	case DropOldest:
+		return "DropOldest"
+	case DropNewest:
+		return "DropNewest"
+	case Reject:
+		return "Reject"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
 // Pipe is a FIFO queue that can be closed with Close().
 // When closed, the read functions will return io.EOF when no data left.
+// If closed with CloseWithError(), then the read functions return the error instead of io.EOF.
 // Please note that this object does NOT suits for io.PipeReader and io.PipeWriter interface.
 // Especially, Close() closes the stream on write side, but the data remains OK on the read side.
 type Pipe[T any] struct {
+	Overflow  OverflowPolicy // policy on appending to a full pipe; meaningful only on a bounded pipe
+	OnDrop    func(v T)      // if not nil, called with each data dropped by the Overflow policy; it may close the pipe
+	SpinCount int            // if > 0, Receive() spins up to SpinCount times before parking
+
 	queue *Queue[T]
 
-	readClosed, writeClosed bool
-	writeCloseCh            chan any
+	capacity int64  // max number of entries in the pipe; 0 for unlimited
+	slots    int64  // number of reserved entries, used only if capacity > 0
+	dropped  uint64 // number of entries dropped by the Overflow policy
+
+	state                     int64 // pipe phase in the upper 32 bits, and the number of running Append() in the lower 32 bits
+	writeClosing, readClosing int32 // set when Close() or CloseRead() is started
+	writeCloseCh              chan any
+	writeDoneCh               chan any // closed when the pipe is closed and no Append() is running
+	writeDone                 int32    // set when writeDoneCh is closed
+	closeErr                  error    // error for the readers set by CloseWithError()
+	writeErr                  error    // error for the writers set by CloseRead()
+
+	readers waitList[T]        // goroutines waiting in Receive()
+	writers waitList[struct{}] // goroutines waiting in AppendContext()
+	spin    int32              // adaptive spin count of Receive(), between 1 and SpinCount
 
-	ch                chan *NotifyCh[any] // channel for notification object for Read()
-	blockingReadCount int32               // number of concurrent Read() running
+	readDeadline deadline // deadline for Receive()
+
+	// hooks for a data held outside of the queue, like the open block of a coalescing BytePipe.
+	// fill() is called only when the queue is empty, and fillable() reports if fill() has a data.
+	fill     func() (T, bool)
+	fillable func() bool
+	dropHook func(v T) // called with each data dropped by the Overflow policy, before OnDrop
 }
 
+// phases of a Pipe. A pipe moves only forward through the phases.
+const (
+	pipeOpen        = iota // open for both read and write
+	pipeWriteClosed        // closed on the write side; the remaining data can be read
+	pipeDrained            // closed on the write side and no data left
+	pipeReadClosed         // closed on the read side; the remaining data are discarded
+)
+
 // Make a new pipe of type T.
 func NewPipe[T any]() *Pipe[T] {
 	return &Pipe[T]{
 		queue:        NewQueue[T](),
 		writeCloseCh: make(chan any),
-		ch:           make(chan *NotifyCh[any], 16),
+		writeDoneCh:  make(chan any),
 	}
 }
 
+// Make a new pipe of type T that holds at most capacity entries.
+// Append() on a full pipe behaves as the Overflow policy of the pipe, which is Block by default.
+// If capacity <= 0, then the pipe is unlimited as NewPipe().
+func NewBoundedPipe[T any](capacity int) *Pipe[T] {
+	q := NewPipe[T]()
+	if capacity > 0 {
+		q.capacity = int64(capacity)
+	}
+	return q
+}
+
 // Number of data entries in the pipe.
 func (q *Pipe[T]) Len() int {
 	return q.queue.Len()
 }
 
+// Max number of data entries in the pipe. Returns 0 if the pipe is unlimited.
+func (q *Pipe[T]) Cap() int {
+	return int(q.capacity)
+}
+
+// Number of data entries dropped by the Overflow policy.
+func (q *Pipe[T]) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
 // Append a data to the pipe.
 // n is current number of entries in the pipe.
+// If the pipe is bounded and full, then the function works as the Overflow policy.
+// With the default Block policy, the function blocks until a free slot is available.
 // If the pipe is closed, an io.ErrClosedPipe is returned.
 func (q *Pipe[T]) Append(v T) (n int, err error) {
-	if q.writeClosed {
-		err = io.ErrClosedPipe
+	return q.AppendContext(context.Background(), v)
+}
+
+// Append a data to the pipe without blocking.
+// If the pipe is bounded and full, then the data is dropped as the Overflow policy,
+// or ErrFull is returned on Block and Reject policy.
+// If the pipe is closed, an io.ErrClosedPipe is returned.
+func (q *Pipe[T]) TryAppend(v T) (n int, err error) {
+	n, old, dropped, err := q.tryAppend(v)
+	if dropped {
+		// the callbacks are called after the Append() is finished, so that they can close the pipe
+		q.drop(old)
+	}
+	return
+}
+
+// TryAppend() without the drop callbacks. old is the data dropped by the Overflow policy if dropped is true.
+func (q *Pipe[T]) tryAppend(v T) (n int, old T, dropped bool, err error) {
+	if !q.beginWrite() {
+		err = q.closedErr()
 		return
 	}
+	defer q.endWrite()
+
+	// pass the data directly to a waiting Receive()
+	if q.handoff(v) {
+		n = q.queue.Len()
+		return
+	}
+
+	for !q.reserve() {
+		switch q.Overflow {
+		case DropNewest:
+			n = q.queue.Len()
+			return n, v, true, nil
+
+		case DropOldest:
+			var ok bool
+			old, ok = q.queue.Dequeue()
+			if !ok {
+				// taken by a reader, or the reserved slot is not filled yet
+				continue
+			}
+			// the slot of the dropped data is taken over by the new data
+			n = q.queue.Enqueue(v)
+			q.readers.wakeOne()
+			return n, old, true, nil
+
+		default: // Block, Reject
+			err = ErrFull
+			return
+		}
+	}
 	n = q.queue.Enqueue(v)
+	q.readers.wakeOne()
+	return
+}
 
+// Append a data to the pipe.
+// If the pipe is bounded and full with Block policy, then the function blocks until a free slot is available, the pipe is closed, or the ctx.Done() is done.
+// With other policies, the function works as TryAppend().
+// If the pipe is closed, an io.ErrClosedPipe is returned.
+func (q *Pipe[T]) AppendContext(ctx context.Context, v T) (n int, err error) {
 	for {
-		var nc *NotifyCh[any]
-		select {
-		case nc = <-q.ch:
-		default:
+		n, err = q.TryAppend(v)
+		if err != ErrFull || q.Overflow != Block {
+			return
 		}
-		if nc == nil || nc.Notify(nil) {
+
+		// register a waiter
+		w := q.writers.add()
+
+		// a slot could be freed before the registration; try again
+		n, err = q.TryAppend(v)
+		if err != ErrFull {
+			q.writers.cancel(w)
+			q.writers.recycle(w)
+			return
+		}
+
+		select {
+		case <-w.ch: // a slot is freed
+			q.writers.recycle(w)
+
+		case <-ctx.Done(): // context error
+			q.writers.cancel(w)
+			q.writers.recycle(w)
+			err = ctx.Err()
+			if err == nil {
+				err = context.Canceled
+			}
 			return
+
+		case <-q.writeCloseCh: // the Pipe is closed
+			q.writers.cancel(w)
+			q.writers.recycle(w)
+			err = q.closedErr()
+			return
+		}
+	}
+}
+
+// get the phase of the pipe and the number of running Append()
+func (q *Pipe[T]) loadState() (phase int, writers int) {
+	s := atomic.LoadInt64(&q.state)
+	return int(s >> 32), int(int32(s))
+}
+
+// move the pipe to a later phase. Returns false if the pipe is already at or beyond the phase.
+func (q *Pipe[T]) advance(phase int) bool {
+	for {
+		s := atomic.LoadInt64(&q.state)
+		if int(s>>32) >= phase {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&q.state, s, int64(phase)<<32|(s&0xffffffff)) {
+			return true
 		}
 	}
 }
 
+// start an Append(). Returns false if the pipe is not open.
+// While any Append() is running, a closed pipe does not move to the drained phase.
+func (q *Pipe[T]) beginWrite() bool {
+	for {
+		s := atomic.LoadInt64(&q.state)
+		if int(s>>32) != pipeOpen {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&q.state, s, s+1) {
+			return true
+		}
+	}
+}
+
+// finish an Append() started by beginWrite()
+func (q *Pipe[T]) endWrite() {
+	s := atomic.AddInt64(&q.state, -1)
+	if int(s>>32) != pipeOpen && int32(s) == 0 {
+		// the last Append() of a closed pipe
+		q.writesDone()
+	}
+}
+
+// signal that the pipe is closed and no Append() is running
+func (q *Pipe[T]) writesDone() {
+	if atomic.CompareAndSwapInt32(&q.writeDone, 0, 1) {
+		close(q.writeDoneCh)
+	}
+}
+
+// reserve a slot for a new entry
+func (q *Pipe[T]) reserve() bool {
+	if q.capacity == 0 {
+		return true
+	}
+	for {
+		n := atomic.LoadInt64(&q.slots)
+		if n >= q.capacity {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&q.slots, n, n+1) {
+			return true
+		}
+	}
+}
+
+// the error for the readers of a closed and drained pipe
+func (q *Pipe[T]) eof() error {
+	phase, _ := q.loadState()
+	if phase == pipeReadClosed {
+		return io.ErrClosedPipe
+	}
+	if q.closeErr != nil {
+		return q.closeErr
+	}
+	return io.EOF
+}
+
+// check if the pipe is open on both sides
+func (q *Pipe[T]) isOpen() bool {
+	phase, _ := q.loadState()
+	return phase == pipeOpen
+}
+
+// hand a data over to a waiting Receive(), only if no data is queued before it.
+// The check is done under the lock of the waiters, so that it is atomic with addReader().
+func (q *Pipe[T]) handoff(v T) bool {
+	l := &q.readers
+	if atomic.LoadInt32(&l.count) == 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if q.queue.Len() > 0 || (q.fillable != nil && q.fillable()) {
+		return false
+	}
+	return l.wakeLocked(v, true)
+}
+
+// register a waiter for a data.
+// Returns nil if a data is available, or the pipe is closed and no Append() is running, after the registration.
+// No data is handed over to the waiter while a data is queued, so the data are received in order.
+func (q *Pipe[T]) addReader() *waiter[T] {
+	l := &q.readers
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the waiter is counted before the check, so that an Append() after the check sees it
+	w := l.addLocked()
+	if q.ready() {
+		l.unlink(w)
+		l.recycleLocked(w)
+		return nil
+	}
+	return w
+}
+
+// check if a read would not block; a data is available, or the pipe is closed and no Append() is running
+func (q *Pipe[T]) ready() bool {
+	return q.queue.Len() > 0 || (q.fillable != nil && q.fillable()) || atomic.LoadInt32(&q.writeDone) != 0
+}
+
+// check if the pipe is closed and no data left for read
+func (q *Pipe[T]) drained() bool {
+	phase, _ := q.loadState()
+	return phase >= pipeDrained
+}
+
+// the error for the writers of a closed pipe
+func (q *Pipe[T]) closedErr() error {
+	if q.writeErr != nil {
+		return q.writeErr
+	}
+	return io.ErrClosedPipe
+}
+
+// count a dropped data and call the OnDrop callback
+func (q *Pipe[T]) drop(v T) {
+	atomic.AddUint64(&q.dropped, 1)
+	if q.dropHook != nil {
+		q.dropHook(v)
+	}
+	if q.OnDrop != nil {
+		q.OnDrop(v)
+	}
+}
+
+// release a slot reserved by an entry, and wake a waiting AppendContext()
+func (q *Pipe[T]) release() {
+	if q.capacity == 0 {
+		return
+	}
+	atomic.AddInt64(&q.slots, -1)
+	q.writers.wakeOne()
+}
+
 // Get a data from the pipe.
 // if there is no data and the pipe is NOT closed, then returns ErrNoData.
-// if there is no data and the pipe is closed, then returns io.EOF.
+// if there is no data and the pipe is closed, then returns io.EOF, or the error given to CloseWithError().
 func (q *Pipe[T]) Fetch() (v T, err error) {
-	if q.readClosed {
-		err = io.EOF
+	if q.drained() {
+		err = q.eof()
 		return
 	}
-	v, ok := q.queue.Dequeue()
+	v, ok := q.dequeue()
 	if ok {
 		return
 	}
-	if q.writeClosed {
-		q.readClosed = true
-		err = io.EOF
+	phase, writers := q.loadState()
+	if phase == pipeWriteClosed && writers == 0 {
+		// no more data can be appended; check again for the data appended before the state check
+		v, ok = q.dequeue()
+		if ok {
+			return
+		}
+		q.advance(pipeDrained)
+		phase = pipeDrained
+	}
+	if phase >= pipeDrained {
+		err = q.eof()
 	} else {
 		err = ErrNoData
 	}
@@ -86,69 +415,201 @@ func (q *Pipe[T]) Fetch() (v T, err error) {
 }
 
 // Receive a data from the pipe.
-// This function blocks until a new data is received, the pipe is closed, or the ctx.Done() is done.
-// Returns io.EOF if the pipe is closed and no data left.
+// This function blocks until a new data is received, the pipe is closed, the read deadline is exceeded, or the ctx.Done() is done.
+// Returns io.EOF, or the error given to CloseWithError(), if the pipe is closed and no data left.
+// Returns os.ErrDeadlineExceeded if the deadline set by SetReadDeadline() is exceeded.
 func (q *Pipe[T]) Receive(ctx context.Context) (p T, err error) {
-	// Increase the waiting Read() count
-	atomic.AddInt32(&q.blockingReadCount, 1)
-	defer atomic.AddInt32(&q.blockingReadCount, -1)
-	if q.readClosed {
-		err = io.EOF
+	if q.readDeadline.expired() {
+		err = os.ErrDeadlineExceeded
 		return
 	}
-
 	for {
 		p, err = q.Fetch()
 		if err != ErrNoData {
 			return
 		}
 
-		// register a notification channel
-		ch := NewNotifyCh[any]()
-		waitCh := ch.FetchChannel()
-		q.ch <- ch
+		// register a waiter
+		w := q.addReader()
+		if w == nil {
+			// a data is appended, or the pipe is closed, before the registration
+			continue
+		}
 
-		select {
-		case <-waitCh: // new data notification
-			p, err = q.Fetch()
-			if err != ErrNoData {
-				return
-			}
-			// (err == ErrNoData) may means that
-			// a data is added but already fetched by another goroutine.
-			// wait again.
+		if !q.spinWait(w) {
+			select {
+			case <-w.ch: // woken by Append()
 
-		case <-ctx.Done(): // context error
-			ch.Cancel() // cancel the notification channel
-			err = ctx.Err()
-			if err == nil {
-				err = context.Canceled
+			case <-ctx.Done(): // context error
+				p, ok := q.readers.cancel(w)
+				q.readers.recycle(w)
+				if ok {
+					// a data is handed over just before the cancel
+					return p, nil
+				}
+				err = ctx.Err()
+				if err == nil {
+					err = context.Canceled
+				}
+				return p, err
+
+			case <-q.writeDoneCh: // the Pipe is closed, and no Append() is running
+				p, ok := q.readers.cancel(w)
+				q.readers.recycle(w)
+				if ok {
+					return p, nil
+				}
+				continue
+
+			case <-q.readDeadline.wait(): // read deadline exceeded
+				p, ok := q.readers.cancel(w)
+				q.readers.recycle(w)
+				if ok {
+					return p, nil
+				}
+				return p, os.ErrDeadlineExceeded
 			}
+		}
+
+		if w.handed {
+			p, err = w.take(), nil
+			q.readers.recycle(w)
 			return
+		}
+		// woken without a data; the data is appended to the queue, but it may be fetched by another goroutine.
+		// try again.
+		q.readers.recycle(w)
+	}
+}
 
-		case <-q.writeCloseCh: // the Pipe is closed
-			// cancel the notification channel and read again
-			ch.Cancel()
+// take a data from the queue, or from the fill() hook if the queue is empty
+func (q *Pipe[T]) dequeue() (v T, ok bool) {
+	v, ok = q.queue.Dequeue()
+	if ok {
+		q.release()
+		return
+	}
+	if q.fill != nil {
+		v, ok = q.fill()
+	}
+	return
+}
+
+// Receive a data from the pipe, waiting at most for the duration d.
+// Returns os.ErrDeadlineExceeded if no data is received in time.
+func (q *Pipe[T]) ReceiveTimeout(d time.Duration) (p T, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	p, err = q.Receive(ctx)
+	if err == context.DeadlineExceeded {
+		err = os.ErrDeadlineExceeded
+	}
+	return
+}
+
+// Set the deadline for Receive(), like net.Conn.SetReadDeadline().
+// After the deadline is exceeded, blocked and future Receive() calls return os.ErrDeadlineExceeded.
+// The deadline can be extended by setting a new one. A zero value for t means no deadline.
+// Always returns nil.
+func (q *Pipe[T]) SetReadDeadline(t time.Time) error {
+	q.readDeadline.set(t)
+	return nil
+}
+
+// spin for a while before parking, polling the wakeup token of the waiter.
+// The spin count grows when spinning is successful, and shrinks otherwise.
+func (q *Pipe[T]) spinWait(w *waiter[T]) bool {
+	limit := int32(q.SpinCount)
+	if limit <= 0 {
+		return false
+	}
+	n := atomic.LoadInt32(&q.spin)
+	if n <= 0 || n > limit {
+		n = limit
+	}
+	for i := int32(0); i < n; i++ {
+		runtime.Gosched()
+		select {
+		case <-w.ch:
+			if n *= 2; n > limit {
+				n = limit
+			}
+			atomic.StoreInt32(&q.spin, n)
+			return true
+		default:
 		}
 	}
+	if n /= 2; n < 1 {
+		n = 1
+	}
+	atomic.StoreInt32(&q.spin, n)
+	return false
 }
 
 // Close the pipe on the write side.
 // After the Close(), Append() will fail but Fetch() and Receive() do work until the data runs out.
+// Blocking AppendContext() calls are returned with io.ErrClosedPipe.
 func (q *Pipe[T]) Close() bool {
-	if q.writeClosed {
+	return q.CloseWithError(nil)
+}
+
+// Close the pipe on the write side with an error, like io.PipeWriter.CloseWithError().
+// After the remaining data are drained, Fetch() and Receive() return err instead of io.EOF.
+// If err is nil, then the function works as Close().
+// Returns false if the pipe is already closed.
+func (q *Pipe[T]) CloseWithError(err error) bool {
+	if !atomic.CompareAndSwapInt32(&q.writeClosing, 0, 1) {
 		return false
 	}
-	q.writeClosed = true
-	close(q.writeCloseCh)
+	q.closeErr = err // must be set before the phase change
+	q.advance(pipeWriteClosed)
+	q.closeWrite()
+	return true
+}
 
-	// kill waiting Receive()
-	for q.blockingReadCount > 0 {
-		select {
-		case ch := <-q.ch:
-			ch.Cancel()
-		default:
+// Close the pipe on the read side, like io.PipeReader.CloseWithError().
+// All data remaining in the pipe are discarded, and n is the number of discarded entries.
+// After the CloseRead(), Append() fails with err, or io.ErrClosedPipe if err is nil,
+// and Fetch() and Receive() return io.ErrClosedPipe.
+// Blocking AppendContext() and Receive() calls are released.
+func (q *Pipe[T]) CloseRead(err error) (n int) {
+	q.closeRead(err, func(T) { n++ })
+	return
+}
+
+// close the read side, calling discard() for each remaining data
+func (q *Pipe[T]) closeRead(err error, discard func(v T)) {
+	if !atomic.CompareAndSwapInt32(&q.readClosing, 0, 1) {
+		return
+	}
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	writeClose := atomic.CompareAndSwapInt32(&q.writeClosing, 0, 1)
+	if writeClose {
+		q.writeErr = err // must be set before the phase change
+	}
+	q.advance(pipeReadClosed)
+	if writeClose {
+		q.closeWrite()
+	}
+	// an Append() started before the phase change may still enqueue a data; wait for it to finish
+	<-q.writeDoneCh
+	for {
+		v, ok := q.queue.Dequeue()
+		if !ok {
+			return
 		}
+		q.release()
+		discard(v)
+	}
+}
+
+// wake the goroutines waiting on the write side
+func (q *Pipe[T]) closeWrite() {
+	// all waiting Receive() and AppendContext() select on the channel, so closing it wakes them at once
+	close(q.writeCloseCh)
+	if _, writers := q.loadState(); writers == 0 {
+		q.writesDone()
 	}
-	return true
 }
@@ -2,9 +2,13 @@ package bufpipe
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -49,9 +53,43 @@ func BenchmarkPipe(b *testing.B) {
 		wg.Wait()
 	}
 
-	for i := 0; i < b.N; i++ {
-		benchFifo()
+	b.Run("fifo", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchFifo()
+		}
+	})
+
+	// Append() to a goroutine waiting in Receive(), and back
+	benchHandoff := func(b *testing.B, spin int) {
+		ping, pong := NewPipe[int](), NewPipe[int]()
+		ping.SpinCount, pong.SpinCount = spin, spin
+		go func() {
+			defer pong.Close()
+			for {
+				n, err := ping.Receive(context.Background())
+				if err != nil {
+					return
+				}
+				pong.Append(n)
+			}
+		}()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ping.Append(i)
+			n, err := pong.Receive(context.Background())
+			if err != nil || n != i {
+				b.Fatalf("invalid receive; must return %d, actual %d (error %v)", i, n, err)
+			}
+		}
+		ping.Close()
 	}
+	b.Run("handoff", func(b *testing.B) {
+		benchHandoff(b, 0)
+	})
+	b.Run("handoff-spin", func(b *testing.B) {
+		benchHandoff(b, 100)
+	})
 }
 
 func TestPipe(t *testing.T) {
@@ -216,3 +254,723 @@ func TestPipe(t *testing.T) {
 		}
 	}
 }
+
+func TestBoundedPipe(t *testing.T) {
+
+	capacity := 4
+	q := NewBoundedPipe[int](capacity)
+	if q.Cap() != capacity {
+		t.Errorf("capacity mismatch; expected %d, actual %d", capacity, q.Cap())
+	}
+
+	// fill the pipe
+	for i := 0; i < capacity; i++ {
+		n, err := q.TryAppend(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i+1 {
+			t.Errorf("queue size mismatch; expected %d, actual %d", i+1, n)
+		}
+	}
+	_, err := q.TryAppend(capacity)
+	if err != ErrFull {
+		t.Errorf("full pipe must return ErrFull, actual %v", err)
+	}
+
+	// blocking append must be terminated by the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = q.AppendContext(ctx, capacity)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("AppendContext on a full pipe must return context error, actual %v", err)
+	}
+
+	// blocking append must be released by Fetch()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := q.Append(capacity)
+		if err != nil {
+			t.Errorf("blocked Append failed: %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	n, err := q.Fetch()
+	if err != nil || n != 0 {
+		t.Errorf("invalid fetch; must return 0, actual %d (error %v)", n, err)
+	}
+	wg.Wait()
+	if q.Len() != capacity {
+		t.Errorf("queue size mismatch; expected %d, actual %d", capacity, q.Len())
+	}
+
+	// blocking append must be released by Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := q.Append(-1)
+		if err != io.ErrClosedPipe {
+			t.Errorf("Append on a closed pipe must return io.ErrClosedPipe, actual %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	wg.Wait()
+
+	// remaining data
+	for i := 1; i <= capacity; i++ {
+		n, err := q.Fetch()
+		if err != nil || n != i {
+			t.Errorf("invalid fetch; must return %d, actual %d (error %v)", i, n, err)
+		}
+	}
+	_, err = q.Fetch()
+	if err != io.EOF {
+		t.Errorf("drained pipe must return io.EOF, actual %v", err)
+	}
+
+	// concurrent producers and consumers
+	bq := NewBoundedPipe[int](capacity)
+	threshold := 10000
+	nIn, nOut := 7, 7
+	var inWg, outWg sync.WaitGroup
+	counts := make([]int, nOut)
+	outWg.Add(nOut)
+	for i := 0; i < nOut; i++ {
+		go func(k int) {
+			defer outWg.Done()
+			for {
+				_, err := bq.Receive(context.Background())
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Errorf("receive failed: %v", err)
+					break
+				}
+				if l := bq.Len(); l > capacity {
+					t.Errorf("bounded pipe overflow: %d", l)
+				}
+				counts[k]++
+			}
+		}(i)
+	}
+	inWg.Add(nIn)
+	for i := 0; i < nIn; i++ {
+		go func(k int) {
+			defer inWg.Done()
+			for i := k; i < threshold; i += nIn {
+				_, err := bq.Append(i)
+				if err != nil {
+					t.Errorf("append failed: %v", err)
+				}
+			}
+		}(i)
+	}
+	inWg.Wait()
+	bq.Close()
+	outWg.Wait()
+	sum := 0
+	for _, c := range counts {
+		sum += c
+	}
+	if sum != threshold {
+		t.Errorf("dequeued entry count not match; expected %d, actual %d", threshold, sum)
+	}
+}
+
+func TestPipeOverflow(t *testing.T) {
+
+	capacity, total := 4, 10
+
+	// DropOldest keeps the newest entries
+	q := NewBoundedPipe[int](capacity)
+	q.Overflow = DropOldest
+	droppedData := make([]int, 0)
+	q.OnDrop = func(v int) {
+		droppedData = append(droppedData, v)
+	}
+	for i := 0; i < total; i++ {
+		_, err := q.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q.Dropped() != uint64(total-capacity) || len(droppedData) != total-capacity {
+		t.Errorf("dropped count mismatch; expected %d, actual %d (callback %d)", total-capacity, q.Dropped(), len(droppedData))
+	}
+	for i, v := range droppedData {
+		if v != i {
+			t.Errorf("dropped data mismatch; expected %d, actual %d", i, v)
+		}
+	}
+	for i := total - capacity; i < total; i++ {
+		n, err := q.Fetch()
+		if err != nil || n != i {
+			t.Errorf("invalid fetch; must return %d, actual %d (error %v)", i, n, err)
+		}
+	}
+
+	// DropNewest keeps the oldest entries
+	q = NewBoundedPipe[int](capacity)
+	q.Overflow = DropNewest
+	for i := 0; i < total; i++ {
+		n, err := q.Append(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > capacity {
+			t.Errorf("queue size overflow: %d", n)
+		}
+	}
+	if q.Dropped() != uint64(total-capacity) {
+		t.Errorf("dropped count mismatch; expected %d, actual %d", total-capacity, q.Dropped())
+	}
+	for i := 0; i < capacity; i++ {
+		n, err := q.Fetch()
+		if err != nil || n != i {
+			t.Errorf("invalid fetch; must return %d, actual %d (error %v)", i, n, err)
+		}
+	}
+
+	// Reject returns ErrFull without blocking
+	q = NewBoundedPipe[int](capacity)
+	q.Overflow = Reject
+	for i := 0; i < total; i++ {
+		_, err := q.Append(i)
+		if i < capacity && err != nil {
+			t.Fatal(err)
+		}
+		if i >= capacity && err != ErrFull {
+			t.Errorf("Append on a full pipe must return ErrFull, actual %v", err)
+		}
+	}
+	if q.Dropped() != 0 {
+		t.Errorf("rejected data must not be counted as dropped: %d", q.Dropped())
+	}
+
+	// concurrent DropOldest
+	q = NewBoundedPipe[int](capacity)
+	q.Overflow = DropOldest
+	threshold, nIn := 10000, 7
+	var received int64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, err := q.Receive(context.Background())
+			if err != nil {
+				if err != io.EOF {
+					t.Errorf("receive failed: %v", err)
+				}
+				return
+			}
+			received++
+		}
+	}()
+	wg.Add(nIn)
+	for i := 0; i < nIn; i++ {
+		go func(k int) {
+			defer wg.Done()
+			for i := k; i < threshold; i += nIn {
+				if _, err := q.Append(i); err != nil {
+					t.Errorf("append failed: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	q.Close()
+	<-done
+	if received+int64(q.Dropped()) != int64(threshold) {
+		t.Errorf("data count mismatch; received %d, dropped %d", received, q.Dropped())
+	}
+}
+
+type testCloseError struct {
+	code int
+}
+
+func (e *testCloseError) Error() string {
+	return "test close error"
+}
+
+func TestPipeCloseWithError(t *testing.T) {
+	closeErr := &testCloseError{code: 42}
+
+	q := NewPipe[int]()
+	q.Append(1)
+	if !q.CloseWithError(closeErr) {
+		t.Fatalf("CloseWithError failed")
+	}
+	if q.CloseWithError(closeErr) || q.Close() {
+		t.Errorf("closing a closed pipe must fail")
+	}
+	if _, err := q.Append(2); err != io.ErrClosedPipe {
+		t.Errorf("Append on a closed pipe must return io.ErrClosedPipe, actual %v", err)
+	}
+	n, err := q.Fetch()
+	if err != nil || n != 1 {
+		t.Errorf("invalid fetch; must return 1, actual %d (error %v)", n, err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = q.Fetch()
+		var ce *testCloseError
+		if !errors.As(err, &ce) || ce.code != 42 {
+			t.Errorf("drained pipe must return the close error, actual %v", err)
+		}
+	}
+	_, err = q.Receive(context.Background())
+	if !errors.Is(err, closeErr) {
+		t.Errorf("drained pipe must return the close error, actual %v", err)
+	}
+
+	// waiting Receive() must be woken with the error
+	q = NewPipe[int]()
+	done := make(chan error)
+	go func() {
+		_, err := q.Receive(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.CloseWithError(closeErr)
+	if err := <-done; err != closeErr {
+		t.Errorf("waiting Receive must return the close error, actual %v", err)
+	}
+
+	// CloseWithError(nil) works as Close()
+	q = NewPipe[int]()
+	q.CloseWithError(nil)
+	if _, err := q.Fetch(); err != io.EOF {
+		t.Errorf("drained pipe must return io.EOF, actual %v", err)
+	}
+}
+
+func TestPipeCloseRead(t *testing.T) {
+	readErr := errors.New("consumer gone")
+
+	q := NewBoundedPipe[int](3)
+	for i := 0; i < 3; i++ {
+		q.Append(i)
+	}
+
+	// a blocked writer and a blocked reader
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := q.Append(3)
+		if err != readErr {
+			t.Errorf("blocked Append must return the CloseRead error, actual %v", err)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	n := q.CloseRead(readErr)
+	wg.Wait()
+	if n != 3 {
+		t.Errorf("discarded count mismatch; expected 3, actual %d", n)
+	}
+	if q.Len() != 0 {
+		t.Errorf("queue size mismatch; expected 0, actual %d", q.Len())
+	}
+	if _, err := q.Append(4); err != readErr {
+		t.Errorf("Append must return the CloseRead error, actual %v", err)
+	}
+	if _, err := q.Fetch(); err != io.ErrClosedPipe {
+		t.Errorf("Fetch must return io.ErrClosedPipe, actual %v", err)
+	}
+	if _, err := q.Receive(context.Background()); err != io.ErrClosedPipe {
+		t.Errorf("Receive must return io.ErrClosedPipe, actual %v", err)
+	}
+
+	// waiting Receive() must be released
+	q = NewPipe[int]()
+	done := make(chan error)
+	go func() {
+		_, err := q.Receive(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.CloseRead(nil)
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Errorf("waiting Receive must return io.ErrClosedPipe, actual %v", err)
+	}
+	if _, err := q.Append(1); err != io.ErrClosedPipe {
+		t.Errorf("Append must return io.ErrClosedPipe, actual %v", err)
+	}
+}
+
+// a single producer and a single consumer must see the data in order; run with -race
+func TestPipeOrder(t *testing.T) {
+	const count = 100000
+	for _, q := range []*Pipe[int]{NewPipe[int](), NewBoundedPipe[int](4)} {
+		go func() {
+			for i := 0; i < count; i++ {
+				q.Append(i)
+				if i%2 == 0 {
+					// let the consumer run between the appends
+					runtime.Gosched()
+				}
+			}
+			q.Close()
+		}()
+		last := -1
+		for {
+			v, err := q.Receive(context.Background())
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != last+1 {
+				t.Fatalf("unexpected data order: got %d after %d", v, last)
+			}
+			last = v
+		}
+		if last != count-1 {
+			t.Errorf("unexpected last data: %d", last)
+		}
+	}
+
+	// a data must not be handed over to a waiter registered while an older data is queued
+	q := NewPipe[int]()
+	q.Append(0)
+	w := q.readers.add() // a Receive() registering after its Fetch() found no data
+	q.Append(1)
+	v, ok := q.readers.cancel(w)
+	q.readers.recycle(w)
+	if ok {
+		t.Errorf("a data is handed over ahead of the queue: %d", v)
+	}
+	for want := 0; want < 2; want++ {
+		if v, err := q.Fetch(); v != want || err != nil {
+			t.Errorf("unexpected fetch result: %d, %v", v, err)
+		}
+	}
+}
+
+// every successful Append() racing with CloseRead() must be counted as discarded
+func TestPipeReceiveRunningAppend(t *testing.T) {
+	// Receive() on a closed pipe waits for a running Append()
+	q := NewPipe[int]()
+	if !q.beginWrite() {
+		t.Fatal("beginWrite() failed")
+	}
+	q.Close()
+	type result struct {
+		v   int
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		v, err := q.Receive(context.Background())
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		t.Fatalf("Receive must wait for the running Append, actual %d, %v", r.v, r.err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.queue.Enqueue(1)
+	q.endWrite()
+	select {
+	case r := <-done:
+		if r.v != 1 || r.err != nil {
+			t.Errorf("unexpected receive result: %d, %v", r.v, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Receive must return after the running Append is finished")
+	}
+	if _, err := q.ReceiveTimeout(time.Second); err != io.EOF {
+		t.Errorf("unexpected receive result: %v", err)
+	}
+}
+
+func TestPipeCloseReadRunningAppend(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		q := NewPipe[int]()
+		var appended int64
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := q.Append(0); err != nil {
+						return
+					}
+					atomic.AddInt64(&appended, 1)
+				}
+			}()
+		}
+		time.Sleep(100 * time.Microsecond)
+		n := q.CloseRead(nil)
+		wg.Wait()
+		if int64(n) != appended || q.Len() != 0 {
+			t.Fatalf("discarded count mismatch; appended %d, discarded %d, left %d", appended, n, q.Len())
+		}
+	}
+}
+
+func TestPipeCloseReadOnDrop(t *testing.T) {
+	// stop the producer on a data loss
+	q := NewBoundedPipe[int](1)
+	q.Overflow = DropNewest
+	var dropped []int
+	q.OnDrop = func(v int) {
+		dropped = append(dropped, v)
+		q.CloseRead(nil)
+	}
+	done := make(chan error)
+	go func() {
+		q.Append(1)
+		_, err := q.Append(2)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || len(dropped) != 1 || dropped[0] != 2 {
+			t.Errorf("unexpected drop result: %v, %v", dropped, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CloseRead() in OnDrop must not block")
+	}
+	if _, err := q.Append(3); err != io.ErrClosedPipe {
+		t.Errorf("Append after CloseRead must fail, actual %v", err)
+	}
+
+	// coalescing BytePipe over MaxBufferedBytes
+	bp := NewBytePipe()
+	bp.CoalesceSize = 4
+	bp.MaxBufferedBytes = 2
+	bp.Overflow = DropNewest
+	bp.OnDrop = func(p []byte) { bp.CloseRead(nil) }
+	go func() {
+		bp.Write([]byte("ab"))
+		_, err := bp.Write([]byte("cd"))
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("CloseRead() in OnDrop must not block")
+	}
+}
+
+// run with -race
+func TestPipeConcurrentClose(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		q := NewPipe[int]()
+		nIn, nOut, nClose := 4, 4, 4
+		var inWg, outWg, closeWg sync.WaitGroup
+
+		// writers count the successfully appended data
+		appended := make([]int, nIn)
+		inWg.Add(nIn)
+		for i := 0; i < nIn; i++ {
+			go func(k int) {
+				defer inWg.Done()
+				for j := 0; j < 10000; j++ {
+					if _, err := q.Append(k); err != nil {
+						if err != io.ErrClosedPipe {
+							t.Errorf("append failed: %v", err)
+						}
+						return
+					}
+					appended[k]++
+				}
+			}(i)
+		}
+
+		// readers with Fetch() and Receive()
+		received := make([][]int, nOut)
+		outWg.Add(nOut)
+		for i := 0; i < nOut; i++ {
+			received[i] = make([]int, nIn)
+			go func(k int) {
+				defer outWg.Done()
+				for {
+					var n int
+					var err error
+					if k%2 == 0 {
+						n, err = q.Fetch()
+						if err == ErrNoData {
+							runtime.Gosched()
+							continue
+						}
+					} else {
+						n, err = q.Receive(context.Background())
+					}
+					if err == io.EOF {
+						return
+					}
+					if err != nil {
+						t.Errorf("read failed: %v", err)
+						return
+					}
+					received[k][n]++
+				}
+			}(i)
+		}
+
+		// concurrent Close()
+		time.Sleep(time.Millisecond)
+		var closed int32
+		closeWg.Add(nClose)
+		for i := 0; i < nClose; i++ {
+			go func() {
+				defer closeWg.Done()
+				if q.Close() {
+					atomic.AddInt32(&closed, 1)
+				}
+			}()
+		}
+		closeWg.Wait()
+		inWg.Wait()
+		outWg.Wait()
+
+		if closed != 1 {
+			t.Fatalf("Close() succeeded %d times", closed)
+		}
+		for k := 0; k < nIn; k++ {
+			sum := 0
+			for i := 0; i < nOut; i++ {
+				sum += received[i][k]
+			}
+			if sum != appended[k] {
+				t.Fatalf("data count mismatch for writer %d; appended %d, received %d", k, appended[k], sum)
+			}
+		}
+		if _, err := q.Fetch(); err != io.EOF {
+			t.Fatalf("drained pipe must return io.EOF, actual %v", err)
+		}
+	}
+}
+
+func BenchmarkPipeReceivers(b *testing.B) {
+	for _, nOut := range []int{1, 16, 1000} {
+		b.Run(fmt.Sprintf("receivers=%d", nOut), func(b *testing.B) {
+			queue := NewPipe[int]()
+			var wg sync.WaitGroup
+			wg.Add(nOut)
+			for i := 0; i < nOut; i++ {
+				go func() {
+					defer wg.Done()
+					for {
+						_, err := queue.Receive(context.Background())
+						if err != nil {
+							if err != io.EOF {
+								b.Error(err)
+							}
+							return
+						}
+					}
+				}()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				queue.Append(i)
+			}
+			queue.Close()
+			wg.Wait()
+		})
+	}
+}
+
+func TestPipeManyReceivers(t *testing.T) {
+	nOut := 1000
+	q := NewPipe[int]()
+
+	// waiting receivers must respect the context
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	wg.Add(nOut)
+	for i := 0; i < nOut; i++ {
+		go func() {
+			defer wg.Done()
+			_, err := q.Receive(ctx)
+			if err != context.DeadlineExceeded {
+				t.Errorf("Receive must return context error, actual %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	if l := atomic.LoadInt32(&q.readers.count); l != 0 {
+		t.Errorf("waiter count mismatch; expected 0, actual %d", l)
+	}
+
+	// every receiver gets a data, and the rest are woken by Close()
+	var received int32
+	wg.Add(nOut)
+	for i := 0; i < nOut; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := q.Receive(context.Background())
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					t.Errorf("receive failed: %v", err)
+					return
+				}
+				atomic.AddInt32(&received, 1)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < nOut/2; i++ {
+		q.Append(i)
+	}
+	q.Close()
+	wg.Wait()
+	if received != int32(nOut/2) {
+		t.Errorf("receive count mismatch; expected %d, actual %d", nOut/2, received)
+	}
+}
+
+func TestPipeReceiveCancel(t *testing.T) {
+	// data handed over to a cancelled Receive() must not be lost
+	q := NewPipe[int]()
+	q.SpinCount = 10
+	threshold, nOut := 10000, 8
+	var received int64
+	var wg sync.WaitGroup
+	wg.Add(nOut)
+	for i := 0; i < nOut; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Microsecond)
+				_, err := q.Receive(ctx)
+				cancel()
+				if err == io.EOF {
+					return
+				}
+				if err == nil {
+					atomic.AddInt64(&received, 1)
+				} else if err != context.DeadlineExceeded {
+					t.Errorf("receive failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < threshold; i++ {
+		q.Append(i)
+		if i%100 == 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	q.Close()
+	wg.Wait()
+	if received != int64(threshold) {
+		t.Errorf("receive count mismatch; expected %d, actual %d", threshold, received)
+	}
+}
@@ -0,0 +1,40 @@
+package bufpipe
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// size classes of pooled buffers; powers of 2 from 1<<minPoolClass to 1<<maxPoolClass bytes
+const (
+	minPoolClass = 6
+	maxPoolClass = 24
+)
+
+// pools of []byte, one for each size class
+var bufPools [maxPoolClass - minPoolClass + 1]sync.Pool
+
+// get a []byte of length n from the pool.
+// The capacity of the buffer is the size class of n. A buffer larger than the max class is not pooled.
+func getBuf(n int) []byte {
+	class := minPoolClass
+	if n > 1<<minPoolClass {
+		class = bits.Len(uint(n - 1))
+	}
+	if class > maxPoolClass {
+		return make([]byte, n)
+	}
+	if v := bufPools[class-minPoolClass].Get(); v != nil {
+		return v.([]byte)[:n]
+	}
+	return make([]byte, n, 1<<class)
+}
+
+// put a buffer back to the pool. A buffer whose capacity is not a size class is ignored.
+func putBuf(p []byte) {
+	c := cap(p)
+	if c < 1<<minPoolClass || c > 1<<maxPoolClass || c&(c-1) != 0 {
+		return
+	}
+	bufPools[bits.Len(uint(c))-1-minPoolClass].Put(p[:0]) //nolint:staticcheck // a slice header is small enough
+}
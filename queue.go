@@ -27,10 +27,10 @@ func NewQueue[T any]() *Queue[T] {
 func (q *Queue[T]) Enqueue(v T) int {
 	pNew := unsafe.Pointer(&queueNode[T]{next: nil, value: v})
 	for {
-		pTail := q.tail
+		pTail := atomic.LoadPointer(&q.tail)
 		tail := (*queueNode[T])(pTail)
-		pNext := tail.next
-		if pTail == q.tail { // tail is still there
+		pNext := atomic.LoadPointer(&tail.next)
+		if pTail == atomic.LoadPointer(&q.tail) { // tail is still there
 			if pNext == nil {
 				// Add entry to the last node
 				if atomic.CompareAndSwapPointer(&tail.next, nil, pNew) {
@@ -48,10 +48,10 @@ func (q *Queue[T]) Enqueue(v T) int {
 // Get a entry from the queue. Fetches the size of entires in the queue.
 func (q *Queue[T]) Dequeue() (value T, ok bool) {
 	for {
-		pHead, pTail := q.head, q.tail
+		pHead, pTail := atomic.LoadPointer(&q.head), atomic.LoadPointer(&q.tail)
 		head := (*queueNode[T])(pHead)
-		pNext := head.next
-		if pHead == q.head {
+		pNext := atomic.LoadPointer(&head.next)
+		if pHead == atomic.LoadPointer(&q.head) {
 			if pHead == pTail {
 				if pNext == nil {
 					// No value
@@ -77,7 +77,7 @@ func (q *Queue[T]) Dequeue() (value T, ok bool) {
 
 // Number of entries in the queue.
 func (q *Queue[T]) Len() int {
-	return int(q.size)
+	return int(atomic.LoadInt64(&q.size))
 }
 
 type queueNode[T any] struct {
@@ -6,6 +6,7 @@ import (
 
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -66,7 +67,7 @@ func TestQueue(t *testing.T) {
 
 	queue2 := NewQueue[int]()
 
-	stopOut := false
+	var stopOut int32
 	testCount := 10000 // 0.006 sec
 	//testCount := 10000000 // 4 sec
 
@@ -80,12 +81,14 @@ func TestQueue(t *testing.T) {
 		go func(k int) {
 			defer outWg.Done()
 			for {
+				// check the flag before Dequeue(), so that the empty queue is observed after the sources are finished
+				stop := atomic.LoadInt32(&stopOut) != 0
 				n, ok := queue1.Dequeue()
 				if ok {
 					counts[k]++
 					queue2.Enqueue(n)
 				}
-				if !ok && stopOut {
+				if !ok && stop {
 					break
 				}
 			}
@@ -113,7 +116,7 @@ func TestQueue(t *testing.T) {
 	if sum != testCount {
 		t.Errorf("enqueued entry count not match; expected %d, actual %d", testCount, sum)
 	}
-	stopOut = true
+	atomic.StoreInt32(&stopOut, 1)
 	outWg.Wait()
 
 	// count number of dequeued entries
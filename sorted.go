@@ -0,0 +1,167 @@
+package bufpipe
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"time"
+)
+
+// Merge the source pipes carrying sorted data into a new pipe, keeping the order by less.
+// A data is appended to the output only when every open source has a data or has reached io.EOF,
+// so that the output is sorted as long as each source is sorted.
+// The output is closed when all sources have reached io.EOF.
+// If a source is closed with an error, or the context is done, the output is closed with the error.
+func MergeSorted[T any](ctx context.Context, less func(a, b T) bool, srcs ...*Pipe[T]) *Pipe[T] {
+	return MergeSortedTimeout(ctx, less, 0, srcs...)
+}
+
+// MergeSorted() with a watermark timeout.
+// If the sources without a data stay idle for the timeout while other sources have data,
+// then the idle sources are skipped until they have a data again.
+// The data from a skipped source may be out of order in the output.
+// If timeout <= 0, then the function works as MergeSorted().
+func MergeSortedTimeout[T any](ctx context.Context, less func(a, b T) bool, timeout time.Duration, srcs ...*Pipe[T]) *Pipe[T] {
+	out := NewPipe[T]()
+	ms := make([]*mergeSource[T], len(srcs))
+	for i, src := range srcs {
+		ms[i] = &mergeSource[T]{p: src}
+	}
+	go mergeSorted(ctx, out, less, timeout, ms)
+	return out
+}
+
+// heap of the sources by the head data
+type sourceHeap[T any] struct {
+	srcs []*mergeSource[T]
+	less func(a, b T) bool
+}
+
+func (h *sourceHeap[T]) Len() int           { return len(h.srcs) }
+func (h *sourceHeap[T]) Less(i, j int) bool { return h.less(h.srcs[i].head, h.srcs[j].head) }
+func (h *sourceHeap[T]) Swap(i, j int)      { h.srcs[i], h.srcs[j] = h.srcs[j], h.srcs[i] }
+func (h *sourceHeap[T]) Push(x any)         { h.srcs = append(h.srcs, x.(*mergeSource[T])) }
+func (h *sourceHeap[T]) Pop() any {
+	n := len(h.srcs) - 1
+	s := h.srcs[n]
+	h.srcs[n] = nil
+	h.srcs = h.srcs[:n]
+	return s
+}
+
+// the goroutine of MergeSorted()
+func mergeSorted[T any](ctx context.Context, out *Pipe[T], less func(a, b T) bool, timeout time.Duration, srcs []*mergeSource[T]) {
+	var (
+		h       = &sourceHeap[T]{less: less}
+		sel     sourceSelect[T]
+		timer   *time.Timer
+		timerOn bool // timer is running, and its channel is not received
+	)
+	stopTimer := func() {
+		if timerOn && !timer.Stop() {
+			<-timer.C
+		}
+		timerOn = false
+	}
+	// set the head of a source
+	setHead := func(s *mergeSource[T], v T) {
+		s.head, s.has, s.idle = v, true, false
+		heap.Push(h, s)
+	}
+	// stop merging; the data held in the heads are discarded
+	stop := func(err error) {
+		stopTimer()
+		for _, s := range srcs {
+			s.unwait()
+		}
+		out.CloseWithError(err)
+	}
+
+	for {
+		// fill the heads
+		blocked := false // an open source without a data, and not skipped by the timeout
+		for i := 0; i < len(srcs); i++ {
+			s := srcs[i]
+			if s.has {
+				continue
+			}
+			if s.w != nil {
+				blocked = blocked || !s.idle
+				continue
+			}
+			v, err := s.p.Fetch()
+			switch {
+			case err == nil:
+				setHead(s, v)
+			case err == ErrNoData:
+				if s.wait() {
+					blocked = blocked || !s.idle
+				} else {
+					// a data is appended, or the pipe is closed, before the registration; retry
+					i--
+				}
+			case err == io.EOF:
+				srcs = append(srcs[:i], srcs[i+1:]...)
+				i--
+			default:
+				stop(err)
+				return
+			}
+		}
+
+		if !blocked && h.Len() > 0 {
+			stopTimer()
+			s := heap.Pop(h).(*mergeSource[T])
+			v := s.head
+			var zero T
+			s.head, s.has = zero, false
+			if _, err := out.AppendContext(ctx, v); err != nil {
+				stop(err)
+				return
+			}
+			continue
+		}
+		if len(srcs) == 0 {
+			stop(nil)
+			return
+		}
+
+		// wait for the sources
+		var timerC <-chan time.Time
+		if timeout > 0 && h.Len() > 0 {
+			if !timerOn {
+				if timer == nil {
+					timer = time.NewTimer(timeout)
+				} else {
+					timer.Reset(timeout)
+				}
+				timerOn = true
+			}
+			timerC = timer.C
+		}
+		i, s, closed := sel.wait(srcs, false, ctx.Done(), timerC)
+		switch {
+		case s != nil:
+			var v T
+			var ok bool
+			if closed {
+				v, ok = s.unwait()
+			} else {
+				v, ok = s.woken()
+			}
+			if ok {
+				setHead(s, v)
+			}
+		case i == 0: // context error
+			stop(contextErr(ctx))
+			return
+		case i == 1: // watermark timeout; skip the sources without a data
+			timerOn = false
+			for _, s := range srcs {
+				if s.w != nil {
+					s.idle = true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package bufpipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMergeSorted(t *testing.T) {
+	const nsrc, count = 10, 1000
+	srcs := make([]*Pipe[int], nsrc)
+	for i := range srcs {
+		srcs[i] = NewPipe[int]()
+	}
+	less := func(a, b int) bool { return a < b }
+	out := MergeSorted(context.Background(), less, srcs...)
+
+	var wg sync.WaitGroup
+	for i, src := range srcs {
+		wg.Add(1)
+		go func(seed int64, src *Pipe[int]) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			v := 0
+			for j := 0; j < count; j++ {
+				v += rnd.Intn(100)
+				src.Append(v)
+				if j%100 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			src.Close()
+		}(int64(i), src)
+	}
+
+	last, total := -1, 0
+	for {
+		v, err := out.Receive(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v < last {
+			t.Fatalf("the output is not sorted: %d after %d", v, last)
+		}
+		last = v
+		total++
+	}
+	wg.Wait()
+	if total != nsrc*count {
+		t.Errorf("unexpected number of data: %d", total)
+	}
+}
+
+func TestMergeSortedTimeout(t *testing.T) {
+	less := func(a, b int) bool { return a < b }
+	s1, s2 := NewPipe[int](), NewPipe[int]()
+
+	// without the timeout, a data is held until every source has a data
+	out := MergeSorted(context.Background(), less, s1, s2)
+	s1.Append(2)
+	if _, err := out.ReceiveTimeout(20 * time.Millisecond); err != os.ErrDeadlineExceeded {
+		t.Errorf("a data must be held while a source is empty, actual %v", err)
+	}
+	s2.Append(1)
+	if v, err := out.ReceiveTimeout(time.Second); v != 1 || err != nil {
+		t.Errorf("unexpected receive result: %d, %v", v, err)
+	}
+	if _, err := out.ReceiveTimeout(20 * time.Millisecond); err != os.ErrDeadlineExceeded {
+		t.Errorf("a data must be held while a source is empty, actual %v", err)
+	}
+	s2.Close()
+	s1.Append(3)
+	for _, want := range []int{2, 3} {
+		if v, err := out.ReceiveTimeout(time.Second); v != want || err != nil {
+			t.Errorf("a source at EOF must not hold the others: %d, %v", v, err)
+		}
+	}
+	errTest := errors.New("test")
+	s1.CloseWithError(errTest)
+	if _, err := out.ReceiveTimeout(time.Second); err != errTest {
+		t.Errorf("the error of a source must be propagated, actual %v", err)
+	}
+
+	// an idle source is skipped after the timeout
+	s1, s2 = NewPipe[int](), NewPipe[int]()
+	out = MergeSortedTimeout(context.Background(), less, 20*time.Millisecond, s1, s2)
+	s1.Append(1)
+	s1.Append(2)
+	for _, want := range []int{1, 2} {
+		if v, err := out.ReceiveTimeout(time.Second); v != want || err != nil {
+			t.Errorf("unexpected receive result: %d, %v", v, err)
+		}
+	}
+	s2.Append(0)
+	if v, err := out.ReceiveTimeout(time.Second); v != 0 || err != nil {
+		t.Errorf("unexpected receive result: %d, %v", v, err)
+	}
+	s1.Close()
+	s2.Close()
+	if _, err := out.ReceiveTimeout(time.Second); err != io.EOF {
+		t.Errorf("unexpected receive result: %v", err)
+	}
+}
@@ -0,0 +1,419 @@
+package bufpipe
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+var DefaultSpillFileSize int64 = 64 * 1024 * 1024 // default size for SpillBytePipe.SpillFileSize
+
+// A byte pipe that spills the data to temporary files when the buffered data exceeds a memory limit.
+// The data written while the in-memory data is over the limit are written to files, and paged back in order by the readers.
+// A spill file is removed when all the data in it are read, when the pipe is drained, or by CloseRead().
+//
+// SpillBytePipe has the same Read(), Write(), ReadFrom() and Close() interface as BytePipe.
+// Read() is safe for concurrent use, and the writes are serialized.
+type SpillBytePipe struct {
+	Dir           string // directory for the spill files; the default directory for temporary files if empty
+	SpillFileSize int64  // size of a spill file to start a new one; DefaultSpillFileSize if 0
+	ReadFromSize  int    // size of the buffer of ReadFrom(); ReadFromBufSize if 0
+
+	memLimit int64
+
+	wmu  sync.Mutex    // serializes writers
+	rsem chan struct{} // read lock; buffered by 1
+	kick chan struct{} // wakes the reader waiting for a data; buffered by 1
+
+	mu         sync.Mutex // guards the fields below
+	chunks     []spillChunk
+	head       int // index of the first chunk in chunks
+	memBytes   int64
+	diskBytes  int64
+	wfile      *spillFile   // spill file being written
+	files      []*spillFile // all spill files not removed
+	writing    int          // number of running writes
+	closed     bool
+	closeErr   error // error for the readers set by CloseWithError()
+	readClosed bool
+	readErr    error // error for the writers set by CloseRead()
+}
+
+// A temporary file holding spilled chunks.
+type spillFile struct {
+	f    *os.File
+	size int64 // bytes written, including the bytes reserved by running writes
+	refs int   // number of chunks not fully read, including the chunks being written
+
+	removed bool // closed and removed, possibly by CloseRead() while a chunk is being written
+}
+
+// A chunk of data, in memory or in a spill file.
+type spillChunk struct {
+	data []byte     // in-memory data; nil for a spilled chunk
+	file *spillFile // spill file of a spilled chunk
+	off  int64      // offset of the remaining data in the file
+	size int        // size of the remaining data in the file
+}
+
+// Create a new SpillBytePipe that keeps at most memoryLimit bytes in memory.
+// A single write larger than memoryLimit is always spilled.
+func NewSpillBytePipe(memoryLimit int) *SpillBytePipe {
+	return &SpillBytePipe{
+		memLimit: int64(memoryLimit),
+		rsem:     make(chan struct{}, 1),
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// Number of unread bytes.
+func (sp *SpillBytePipe) Buffered() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.memBytes + sp.diskBytes
+}
+
+// Number of unread bytes in memory.
+func (sp *SpillBytePipe) MemoryBytes() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.memBytes
+}
+
+// Number of unread bytes in the spill files.
+func (sp *SpillBytePipe) DiskBytes() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.diskBytes
+}
+
+// io.Writer interface for SpillBytePipe.
+// The data is copied to memory, or written to a spill file if the in-memory data would exceed the memory limit.
+func (sp *SpillBytePipe) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	sp.wmu.Lock()
+	defer sp.wmu.Unlock()
+	return sp.write(p)
+}
+
+// write p; the write lock must be held
+func (sp *SpillBytePipe) write(p []byte) (n int, err error) {
+	sp.mu.Lock()
+	if err = sp.writeErr(); err != nil {
+		sp.mu.Unlock()
+		return
+	}
+	if sp.memBytes+int64(len(p)) <= sp.memLimit {
+		data := make([]byte, len(p))
+		copy(data, p)
+		sp.push(spillChunk{data: data})
+		sp.memBytes += int64(len(p))
+		sp.mu.Unlock()
+		sp.wake()
+		return len(p), nil
+	}
+
+	// reserve a room in the spill file
+	f, err := sp.spillFile()
+	if err != nil {
+		sp.mu.Unlock()
+		return
+	}
+	off := f.size
+	f.size += int64(len(p))
+	f.refs++
+	sp.writing++
+	sp.mu.Unlock()
+
+	_, err = f.f.WriteAt(p, off)
+
+	sp.mu.Lock()
+	sp.writing--
+	if e := sp.writeErr(); e != nil {
+		// the file may be closed by CloseRead() during the write
+		err = e
+	}
+	if err != nil {
+		sp.unref(f)
+		sp.mu.Unlock()
+		sp.wake()
+		return
+	}
+	sp.push(spillChunk{file: f, off: off, size: len(p)})
+	sp.diskBytes += int64(len(p))
+	sp.mu.Unlock()
+	sp.wake()
+	return len(p), nil
+}
+
+// get the spill file to write, starting a new one if needed; the lock must be held
+func (sp *SpillBytePipe) spillFile() (*spillFile, error) {
+	limit := sp.SpillFileSize
+	if limit <= 0 {
+		limit = DefaultSpillFileSize
+	}
+	if sp.wfile != nil && sp.wfile.size < limit {
+		return sp.wfile, nil
+	}
+	f, err := os.CreateTemp(sp.Dir, "bufpipe-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	old := sp.wfile
+	sp.wfile = &spillFile{f: f}
+	sp.files = append(sp.files, sp.wfile)
+	if old != nil && old.refs == 0 {
+		sp.remove(old)
+	}
+	return sp.wfile, nil
+}
+
+// the error for the writers; the lock must be held
+func (sp *SpillBytePipe) writeErr() error {
+	if sp.readClosed {
+		return sp.readErr
+	}
+	if sp.closed {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// append a chunk; the lock must be held
+func (sp *SpillBytePipe) push(c spillChunk) {
+	sp.chunks = append(sp.chunks, c)
+}
+
+// remove the first chunk; the lock must be held
+func (sp *SpillBytePipe) pop() {
+	sp.chunks[sp.head] = spillChunk{}
+	sp.head++
+	if sp.head == len(sp.chunks) {
+		sp.chunks, sp.head = sp.chunks[:0], 0
+		if sp.wfile != nil && sp.wfile.refs == 0 {
+			// drained
+			sp.remove(sp.wfile)
+		}
+	} else if sp.head >= 1024 && sp.head*2 >= len(sp.chunks) {
+		n := copy(sp.chunks, sp.chunks[sp.head:])
+		sp.chunks, sp.head = sp.chunks[:n], 0
+	}
+}
+
+// release a reference to a spill file, and remove the file if it is no longer used; the lock must be held
+func (sp *SpillBytePipe) unref(f *spillFile) {
+	f.refs--
+	if f.refs > 0 {
+		return
+	}
+	if f != sp.wfile || sp.head == len(sp.chunks) {
+		// a fully read file, or the pipe is drained
+		sp.remove(f)
+	}
+}
+
+// close and remove a spill file; the lock must be held
+func (sp *SpillBytePipe) remove(f *spillFile) {
+	if f.removed {
+		return
+	}
+	f.removed = true
+	f.f.Close()
+	os.Remove(f.f.Name())
+	if f == sp.wfile {
+		sp.wfile = nil
+	}
+	for i, g := range sp.files {
+		if g == f {
+			sp.files = append(sp.files[:i], sp.files[i+1:]...)
+			break
+		}
+	}
+}
+
+// wake the reader waiting for a data
+func (sp *SpillBytePipe) wake() {
+	select {
+	case sp.kick <- struct{}{}:
+	default:
+	}
+}
+
+// io.Reader interface for SpillBytePipe.
+func (sp *SpillBytePipe) Read(p []byte) (n int, err error) {
+	return sp.ReadContext(context.Background(), p)
+}
+
+// Read with a context.
+// The function blocks until some data is available, the pipe is closed, or the ctx.Done() is done.
+// Returns io.EOF, or the error given to CloseWithError(), if the pipe is closed and no data left.
+func (sp *SpillBytePipe) ReadContext(ctx context.Context, p []byte) (n int, err error) {
+	select {
+	case sp.rsem <- struct{}{}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	defer func() { <-sp.rsem }()
+
+	for len(p) > 0 {
+		sp.mu.Lock()
+		if sp.readClosed {
+			sp.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if sp.head == len(sp.chunks) {
+			done := sp.closed && sp.writing == 0
+			if done {
+				sp.cleanup()
+			}
+			sp.mu.Unlock()
+			if n > 0 {
+				// the error, if any, will be reported on the next Read()
+				return
+			}
+			if done {
+				err = io.EOF
+				if sp.closeErr != nil {
+					err = sp.closeErr
+				}
+				return
+			}
+			select {
+			case <-sp.kick:
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+			continue
+		}
+
+		c := &sp.chunks[sp.head]
+		if c.file == nil {
+			sz := copy(p, c.data)
+			c.data = c.data[sz:]
+			sp.memBytes -= int64(sz)
+			if len(c.data) == 0 {
+				sp.pop()
+			}
+			sp.mu.Unlock()
+			p = p[sz:]
+			n += sz
+			continue
+		}
+
+		// page in a spilled chunk; the file is kept while the chunk is referenced
+		f, off, sz := c.file, c.off, c.size
+		sp.mu.Unlock()
+		if sz > len(p) {
+			sz = len(p)
+		}
+		sz, err = f.f.ReadAt(p[:sz], off)
+
+		sp.mu.Lock()
+		if sp.readClosed {
+			sp.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if err != nil {
+			sp.mu.Unlock()
+			return
+		}
+		c = &sp.chunks[sp.head]
+		c.off += int64(sz)
+		c.size -= sz
+		sp.diskBytes -= int64(sz)
+		if c.size == 0 {
+			sp.pop()
+			sp.unref(f)
+		}
+		sp.mu.Unlock()
+		p = p[sz:]
+		n += sz
+	}
+	return
+}
+
+// remove all spill files; the lock must be held
+func (sp *SpillBytePipe) cleanup() {
+	for len(sp.files) > 0 {
+		sp.remove(sp.files[0])
+	}
+}
+
+// io.ReaderFrom interface for SpillBytePipe.
+// The data is read into a buffer of sp.ReadFromSize, and written as Write() as soon as it is read.
+func (sp *SpillBytePipe) ReadFrom(r io.Reader) (n int64, err error) {
+	size := sp.ReadFromSize
+	if size <= 0 {
+		size = ReadFromBufSize
+	}
+	buf := make([]byte, size)
+	sp.wmu.Lock()
+	defer sp.wmu.Unlock()
+	for {
+		sz, e := r.Read(buf)
+		if sz > 0 {
+			if _, err = sp.write(buf[:sz]); err != nil {
+				return
+			}
+			n += int64(sz)
+		}
+		if e != nil {
+			if e != io.EOF {
+				err = e
+			}
+			return
+		}
+	}
+}
+
+// Close the pipe on the write side.
+// The remaining data can be read, and the spill files are removed when the pipe is drained.
+// Returns false if the pipe is already closed.
+func (sp *SpillBytePipe) Close() bool {
+	return sp.CloseWithError(nil)
+}
+
+// Close the pipe on the write side with an error.
+// After the remaining data are read, Read() returns err instead of io.EOF.
+// Returns false if the pipe is already closed.
+func (sp *SpillBytePipe) CloseWithError(err error) bool {
+	sp.mu.Lock()
+	if sp.closed {
+		sp.mu.Unlock()
+		return false
+	}
+	sp.closed, sp.closeErr = true, err
+	if sp.head == len(sp.chunks) && sp.writing == 0 {
+		// no data left
+		sp.cleanup()
+	}
+	sp.mu.Unlock()
+	sp.wake()
+	return true
+}
+
+// Close the pipe on the read side.
+// All remaining data are discarded, and the spill files are removed at once.
+// After the CloseRead(), Write() and ReadFrom() fail with err, or io.ErrClosedPipe if err is nil,
+// and Read() returns io.ErrClosedPipe.
+func (sp *SpillBytePipe) CloseRead(err error) {
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	sp.mu.Lock()
+	if !sp.readClosed {
+		sp.readClosed, sp.readErr = true, err
+		sp.closed = true
+		for i := sp.head; i < len(sp.chunks); i++ {
+			sp.chunks[i] = spillChunk{}
+		}
+		sp.chunks, sp.head = nil, 0
+		sp.memBytes, sp.diskBytes = 0, 0
+		sp.cleanup()
+	}
+	sp.mu.Unlock()
+	sp.wake()
+}
@@ -0,0 +1,185 @@
+package bufpipe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// number of spill files in dir
+func countSpillFiles(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSpillBytePipe(t *testing.T) {
+	dir := t.TempDir()
+	sp := NewSpillBytePipe(100)
+	sp.Dir = dir
+	sp.SpillFileSize = 1000
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// write with various sizes before reading, to spill most of the data over several files
+	var written int
+	for i := 1; written < len(data); i++ {
+		sz := i * 7 % 300
+		if written+sz > len(data) {
+			sz = len(data) - written
+		}
+		if _, err := sp.Write(data[written : written+sz]); err != nil {
+			t.Fatal(err)
+		}
+		written += sz
+	}
+	if sp.Buffered() != int64(len(data)) {
+		t.Errorf("buffered bytes mismatch; expected %d, actual %d", len(data), sp.Buffered())
+	}
+	if sp.MemoryBytes() > 100 {
+		t.Errorf("in-memory bytes over the limit: %d", sp.MemoryBytes())
+	}
+	if sp.MemoryBytes()+sp.DiskBytes() != int64(len(data)) {
+		t.Errorf("unexpected memory and disk bytes: %d, %d", sp.MemoryBytes(), sp.DiskBytes())
+	}
+	if n := countSpillFiles(t, dir); n < 2 {
+		t.Errorf("unexpected number of spill files: %d", n)
+	}
+
+	// read all in order
+	var rbuf bytes.Buffer
+	buf := make([]byte, 123)
+	for rbuf.Len() < len(data)/2 {
+		n, err := sp.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rbuf.Write(buf[:n])
+	}
+	if n := countSpillFiles(t, dir); n >= 10 {
+		t.Errorf("spill files must be removed as they are read: %d", n)
+	}
+	sp.Close()
+	if _, err := sp.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("Write on a closed pipe must return io.ErrClosedPipe, actual %v", err)
+	}
+	if _, err := rbuf.ReadFrom(sp); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rbuf.Bytes(), data) {
+		t.Errorf("read data mismatch")
+	}
+	if sp.Buffered() != 0 || sp.DiskBytes() != 0 {
+		t.Errorf("unexpected buffered bytes after drain: %d, %d", sp.Buffered(), sp.DiskBytes())
+	}
+	if n := countSpillFiles(t, dir); n != 0 {
+		t.Errorf("spill files must be removed on drain: %d", n)
+	}
+}
+
+func TestSpillBytePipeReadFrom(t *testing.T) {
+	dir := t.TempDir()
+	sp := NewSpillBytePipe(1000)
+	sp.Dir = dir
+	sp.ReadFromSize = 100
+
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	done := make(chan error)
+	go func() {
+		_, err := sp.ReadFrom(bytes.NewReader(data))
+		sp.CloseWithError(err)
+		done <- err
+	}()
+	var rbuf bytes.Buffer
+	if _, err := rbuf.ReadFrom(sp); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rbuf.Bytes(), data) {
+		t.Errorf("read data mismatch")
+	}
+	if n := countSpillFiles(t, dir); n != 0 {
+		t.Errorf("spill files must be removed on drain: %d", n)
+	}
+
+	// the error given to CloseWithError is returned after the data
+	sp = NewSpillBytePipe(0)
+	sp.Dir = dir
+	sp.Write([]byte("abc"))
+	errTest := errors.New("test")
+	sp.CloseWithError(errTest)
+	b, err := io.ReadAll(sp)
+	if string(b) != "abc" || err != errTest {
+		t.Errorf("unexpected read result: %q, %v", b, err)
+	}
+}
+
+func TestSpillBytePipeCloseRead(t *testing.T) {
+	dir := t.TempDir()
+	sp := NewSpillBytePipe(0)
+	sp.Dir = dir
+	if _, err := sp.Write([]byte("spilled")); err != nil {
+		t.Fatal(err)
+	}
+	if sp.DiskBytes() != 7 {
+		t.Errorf("unexpected disk bytes: %d", sp.DiskBytes())
+	}
+	if n := countSpillFiles(t, dir); n != 1 {
+		t.Errorf("unexpected number of spill files: %d", n)
+	}
+	errTest := errors.New("test")
+	sp.CloseRead(errTest)
+	if n := countSpillFiles(t, dir); n != 0 {
+		t.Errorf("spill files must be removed on CloseRead: %d", n)
+	}
+	if _, err := sp.Write([]byte("x")); err != errTest {
+		t.Errorf("Write after CloseRead must return the error, actual %v", err)
+	}
+	if _, err := sp.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("Read after CloseRead must return io.ErrClosedPipe, actual %v", err)
+	}
+	if sp.Buffered() != 0 {
+		t.Errorf("unexpected buffered bytes after CloseRead: %d", sp.Buffered())
+	}
+}
+
+func TestSpillBytePipeCloseReadWrite(t *testing.T) {
+	// CloseRead() during a spilled write
+	errTest := errors.New("test")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	for i := 0; i < 20; i++ {
+		dir := t.TempDir()
+		sp := NewSpillBytePipe(0)
+		sp.Dir = dir
+		done := make(chan error, 1)
+		go func() {
+			_, err := sp.Write(data)
+			done <- err
+		}()
+		// wait for the WriteAt() to start
+		for writing := 0; writing == 0 && len(done) == 0; {
+			runtime.Gosched()
+			sp.mu.Lock()
+			writing = sp.writing
+			sp.mu.Unlock()
+		}
+		sp.CloseRead(errTest)
+		if err := <-done; err != nil && err != errTest {
+			t.Fatalf("Write during CloseRead must return the error, actual %v", err)
+		}
+		if n := countSpillFiles(t, dir); n != 0 {
+			t.Fatalf("spill files must be removed on CloseRead: %d", n)
+		}
+	}
+}
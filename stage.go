@@ -0,0 +1,204 @@
+package bufpipe
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Options of the pipeline stages, Map(), Filter() and FlatMap().
+type StageOptions struct {
+	Workers  int  // number of goroutines calling the stage function; 1 if <= 0
+	Ordered  bool // keep the order of the source data in the output when Workers > 1
+	Capacity int  // max number of entries in the output pipe; unlimited if <= 0
+}
+
+// Make a pipe of the results of f for each data in src.
+// The output is closed when src is closed and drained, with the error of src if any.
+// If f returns an error, or the ctx is done, then the stage stops and the output is closed with the error.
+// With multiple workers, the order of the output is kept only if opts.Ordered is set.
+func Map[In, Out any](ctx context.Context, src *Pipe[In], f func(In) (Out, error), opts StageOptions) *Pipe[Out] {
+	return stage(ctx, src, f, func(ctx context.Context, out *Pipe[Out], v Out) (err error) {
+		_, err = out.AppendContext(ctx, v)
+		return
+	}, opts)
+}
+
+// Make a pipe of the data in src for which keep returns true. See Map().
+func Filter[T any](ctx context.Context, src *Pipe[T], keep func(T) (bool, error), opts StageOptions) *Pipe[T] {
+	type result struct {
+		v    T
+		keep bool
+	}
+	f := func(v T) (r result, err error) {
+		r.v = v
+		r.keep, err = keep(v)
+		return
+	}
+	return stage(ctx, src, f, func(ctx context.Context, out *Pipe[T], r result) (err error) {
+		if r.keep {
+			_, err = out.AppendContext(ctx, r.v)
+		}
+		return
+	}, opts)
+}
+
+// Make a pipe of all data in the results of f for each data in src. See Map().
+func FlatMap[In, Out any](ctx context.Context, src *Pipe[In], f func(In) ([]Out, error), opts StageOptions) *Pipe[Out] {
+	return stage(ctx, src, f, func(ctx context.Context, out *Pipe[Out], vs []Out) (err error) {
+		for _, v := range vs {
+			if _, err = out.AppendContext(ctx, v); err != nil {
+				return
+			}
+		}
+		return
+	}, opts)
+}
+
+// a data in process by an ordered stage
+type stageJob[In, R any] struct {
+	v    In
+	r    R
+	err  error
+	done chan struct{} // closed when r and err are set
+}
+
+// run a stage; f is called for each data in src, and its result is passed to emit() to be appended to the output
+func stage[In, R, Out any](ctx context.Context, src *Pipe[In], f func(In) (R, error), emit func(context.Context, *Pipe[Out], R) error, opts StageOptions) *Pipe[Out] {
+	out := NewBoundedPipe[Out](opts.Capacity)
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		srcErr   error // error of src; passed to the output after the data in process
+	)
+	// stop the stage with an error; only the first error is passed to the output
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	// receive a data from src; ok is false at the end of src
+	receive := func() (v In, ok bool) {
+		v, err := src.Receive(ctx)
+		switch {
+		case err == nil:
+			return v, true
+		case ctx.Err() != nil:
+			fail(contextErr(ctx))
+		case err != io.EOF:
+			mu.Lock()
+			srcErr = err
+			mu.Unlock()
+		}
+		return
+	}
+
+	if workers == 1 || !opts.Ordered {
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					v, ok := receive()
+					if !ok {
+						return
+					}
+					r, err := f(v)
+					if err == nil {
+						err = emit(ctx, out, r)
+					}
+					if err != nil {
+						fail(err)
+						return
+					}
+				}
+			}()
+		}
+	} else {
+		jobs := make(chan *stageJob[In, R], workers)    // jobs for the workers
+		results := make(chan *stageJob[In, R], workers) // jobs in the order of the source
+
+		// dispatcher
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(jobs)
+			defer close(results)
+			for {
+				v, ok := receive()
+				if !ok {
+					return
+				}
+				j := &stageJob[In, R]{v: v, done: make(chan struct{})}
+				select {
+				case results <- j:
+				case <-ctx.Done():
+					fail(contextErr(ctx))
+					return
+				}
+				select {
+				case jobs <- j:
+				case <-ctx.Done():
+					fail(contextErr(ctx))
+					return
+				}
+			}
+		}()
+
+		// workers
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range jobs {
+					if j.err = ctx.Err(); j.err == nil {
+						j.r, j.err = f(j.v)
+					}
+					close(j.done)
+				}
+			}()
+		}
+
+		// emitter
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range results {
+				select {
+				case <-j.done:
+				case <-ctx.Done():
+					fail(contextErr(ctx))
+					return
+				}
+				err := j.err
+				if err == nil {
+					err = emit(ctx, out, j.r)
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		if firstErr == nil {
+			firstErr = srcErr
+		}
+		out.CloseWithError(firstErr)
+	}()
+	return out
+}
@@ -0,0 +1,114 @@
+package bufpipe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// receive all data from a pipe until an error
+func receiveAll[T any](q *Pipe[T]) (vs []T, err error) {
+	for {
+		var v T
+		v, err = q.ReceiveTimeout(5 * time.Second)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		vs = append(vs, v)
+	}
+}
+
+func TestStages(t *testing.T) {
+	const count = 1000
+	for _, opts := range []StageOptions{
+		{},
+		{Workers: 4, Capacity: 10},
+		{Workers: 4, Ordered: true},
+	} {
+		src := NewPipe[int]()
+		go func() {
+			for i := 0; i < count; i++ {
+				src.Append(i)
+			}
+			src.Close()
+		}()
+		ctx := context.Background()
+		even := Filter(ctx, src, func(v int) (bool, error) { return v%2 == 0, nil }, opts)
+		pairs := FlatMap(ctx, even, func(v int) ([]int, error) {
+			if v%10 == 0 {
+				// jitter the workers
+				time.Sleep(time.Millisecond)
+			}
+			return []int{v, v + 1}, nil
+		}, opts)
+		strs := Map(ctx, pairs, func(v int) (string, error) { return strconv.Itoa(v), nil }, opts)
+
+		res, err := receiveAll(strs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != count {
+			t.Fatalf("unexpected number of results with %+v: %d", opts, len(res))
+		}
+		vs := make([]int, len(res))
+		for i, s := range res {
+			vs[i], _ = strconv.Atoi(s)
+		}
+		if opts.Workers > 1 && !opts.Ordered {
+			sort.Ints(vs)
+		}
+		for i, v := range vs {
+			if v != i {
+				t.Fatalf("unexpected result with %+v at %d: %d", opts, i, v)
+			}
+		}
+	}
+}
+
+func TestStageError(t *testing.T) {
+	errTest := errors.New("test")
+	for _, opts := range []StageOptions{{}, {Workers: 4, Ordered: true}} {
+		// an error of the function
+		src := NewPipe[int]()
+		for i := 0; i < 10; i++ {
+			src.Append(i)
+		}
+		out := Map(context.Background(), src, func(v int) (int, error) {
+			if v == 5 {
+				return 0, errTest
+			}
+			return v, nil
+		}, opts)
+		res, err := receiveAll(out)
+		if err != errTest {
+			t.Errorf("the error of the function must be propagated, actual %v", err)
+		}
+		if opts.Ordered && len(res) != 5 {
+			t.Errorf("unexpected results before the error: %v", res)
+		}
+
+		// an error of the source
+		src = NewPipe[int]()
+		src.Append(1)
+		src.CloseWithError(errTest)
+		out = Map(context.Background(), src, func(v int) (int, error) { return v, nil }, opts)
+		if res, err := receiveAll(out); len(res) != 1 || err != errTest {
+			t.Errorf("the error of the source must be propagated: %v, %v", res, err)
+		}
+
+		// context error
+		ctx, cancel := context.WithCancel(context.Background())
+		out = Map(ctx, NewPipe[int](), func(v int) (int, error) { return v, nil }, opts)
+		cancel()
+		if _, err := receiveAll(out); err != context.Canceled {
+			t.Errorf("the context error must be propagated, actual %v", err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package bufpipe
+
+import (
+	"context"
+	"io"
+)
+
+// a branch of Tee()
+type teeBranch[T any] interface {
+	AppendContext(ctx context.Context, v T) (n int, err error)
+	CloseWithError(err error) bool
+}
+
+// Split the source pipe into n pipes, each of which receives all data from src.
+// The data are read from src by a goroutine, and appended to every branch.
+// When src is closed and drained, the branches are closed with the error of src, or with Close() on io.EOF.
+// A branch closed by CloseRead() is skipped without affecting the others,
+// and the goroutine finishes reading src when all branches are closed.
+func Tee[T any](src *Pipe[T], n int) []*Pipe[T] {
+	return TeeBounded(src, n, 0)
+}
+
+// Tee() with bounded branches, which hold at most limit entries each.
+// A full branch blocks the others until its data are read, or it is closed by CloseRead().
+// If limit <= 0, then the branches are unlimited as Tee().
+func TeeBounded[T any](src *Pipe[T], n, limit int) []*Pipe[T] {
+	branches := make([]*Pipe[T], n)
+	for i := range branches {
+		branches[i] = NewBoundedPipe[T](limit)
+	}
+	go tee[T](src.Receive, branches)
+	return branches
+}
+
+// Split the source BytePipe into n BytePipes, each of which receives all data from src. See Tee().
+// The data blocks are shared by the branches without copying, so they must not be modified by the consumers.
+func TeeBytes(src *BytePipe, n int) []*BytePipe {
+	return TeeBytesBounded(src, n, 0)
+}
+
+// TeeBytes() with bounded branches, which buffer at most maxBytes bytes each, as BytePipe.MaxBufferedBytes.
+// A full branch blocks the others until its data are read, or it is closed by CloseRead().
+// If maxBytes <= 0, then the branches are unlimited as TeeBytes().
+func TeeBytesBounded(src *BytePipe, n, maxBytes int) []*BytePipe {
+	branches := make([]*BytePipe, n)
+	for i := range branches {
+		branches[i] = NewBytePipe()
+		if maxBytes > 0 {
+			branches[i].MaxBufferedBytes = maxBytes
+		}
+	}
+	go tee[[]byte](src.Receive, branches)
+	return branches
+}
+
+// the goroutine of Tee(); copies the data from receive() to the branches
+func tee[T any, B teeBranch[T]](receive func(ctx context.Context) (T, error), branches []B) {
+	ctx := context.Background()
+	live := append([]B(nil), branches...)
+	for len(live) > 0 {
+		v, err := receive(ctx)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			for _, b := range live {
+				b.CloseWithError(err)
+			}
+			return
+		}
+		for i := 0; i < len(live); i++ {
+			if _, err := live[i].AppendContext(ctx, v); err != nil {
+				// closed by the reader
+				live = append(live[:i], live[i+1:]...)
+				i--
+			}
+		}
+	}
+}
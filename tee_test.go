@@ -0,0 +1,119 @@
+package bufpipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTee(t *testing.T) {
+	const n, count = 3, 1000
+	src := NewPipe[int]()
+	branches := TeeBounded(src, n, 10)
+
+	var wg sync.WaitGroup
+	for _, b := range branches {
+		wg.Add(1)
+		go func(b *Pipe[int]) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				v, err := b.Receive(context.Background())
+				if err == io.EOF {
+					if i != count {
+						t.Errorf("unexpected number of data: %d", i)
+					}
+					return
+				}
+				if v != i || err != nil {
+					t.Errorf("unexpected receive result: %d, %v", v, err)
+					return
+				}
+			}
+		}(b)
+	}
+	for i := 0; i < count; i++ {
+		src.Append(i)
+	}
+	src.Close()
+	wg.Wait()
+
+	// the error of the source is propagated
+	src = NewPipe[int]()
+	branches = Tee(src, 2)
+	errTest := errors.New("test")
+	src.Append(1)
+	src.CloseWithError(errTest)
+	for _, b := range branches {
+		if v, err := b.ReceiveTimeout(time.Second); v != 1 || err != nil {
+			t.Errorf("unexpected receive result: %d, %v", v, err)
+		}
+		if _, err := b.ReceiveTimeout(time.Second); err != errTest {
+			t.Errorf("the error of the source must be propagated, actual %v", err)
+		}
+	}
+}
+
+func TestTeeCloseBranch(t *testing.T) {
+	// a closed branch must not stall the others
+	src := NewPipe[int]()
+	branches := TeeBounded(src, 2, 1)
+	src.Append(1)
+	src.Append(2)
+	time.Sleep(10 * time.Millisecond)
+	branches[0].CloseRead(nil)
+	for i := 1; i <= 3; i++ {
+		if i == 3 {
+			src.Append(3)
+		}
+		if v, err := branches[1].ReceiveTimeout(time.Second); v != i || err != nil {
+			t.Errorf("unexpected receive result: %d, %v", v, err)
+		}
+	}
+	src.Close()
+	if _, err := branches[1].ReceiveTimeout(time.Second); err != io.EOF {
+		t.Errorf("unexpected receive result: %v", err)
+	}
+}
+
+func TestTeeBytes(t *testing.T) {
+	src := NewBytePipe()
+	branches := TeeBytesBounded(src, 2, 8)
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	go func() {
+		for i := 0; i < len(data); i += 4 {
+			src.Write(data[i : i+4])
+		}
+		src.Close()
+	}()
+
+	var wg sync.WaitGroup
+	results := make([][]byte, len(branches))
+	for i, b := range branches {
+		wg.Add(1)
+		go func(i int, b *BytePipe) {
+			defer wg.Done()
+			results[i], _ = io.ReadAll(b)
+		}(i, b)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if !bytes.Equal(r, data) {
+			t.Errorf("unexpected branch data: %q", r)
+		}
+	}
+
+	// the blocks are shared by the branches
+	src = NewBytePipe()
+	branches = TeeBytes(src, 2)
+	src.Append(data)
+	p0, _ := branches[0].ReceiveTimeout(time.Second)
+	p1, _ := branches[1].ReceiveTimeout(time.Second)
+	if len(p0) == 0 || &p0[0] != &p1[0] {
+		t.Errorf("the blocks must be shared")
+	}
+}
@@ -0,0 +1,139 @@
+package bufpipe
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A list of goroutines waiting for an event of a Pipe.
+// Any number of waiters can be registered, and a waiter can be removed at any time without leaving garbage.
+// Waiters are recycled through a free list, so waiting does not allocate in steady state.
+type waitList[T any] struct {
+	mu         sync.Mutex
+	head, tail *waiter[T]
+	free       *waiter[T] // recycled waiters, linked by next
+	count      int32      // number of registered waiters; read without the lock for the fast path
+}
+
+// A goroutine waiting in a waitList.
+// The waiter is woken by a token sent to ch, optionally with a data handed over.
+type waiter[T any] struct {
+	prev, next *waiter[T]
+	listed     bool
+	ch         chan struct{} // wakeup token; buffered by 1
+	handed     bool          // value is handed over by the waker
+	value      T
+}
+
+// get a recycled or a new waiter, and register it at the end of the list
+func (l *waitList[T]) add() (w *waiter[T]) {
+	l.mu.Lock()
+	w = l.addLocked()
+	l.mu.Unlock()
+	return
+}
+
+// add() with the lock held
+func (l *waitList[T]) addLocked() (w *waiter[T]) {
+	w = l.free
+	if w != nil {
+		l.free = w.next
+	} else {
+		w = &waiter[T]{ch: make(chan struct{}, 1)}
+	}
+	w.prev, w.next = l.tail, nil
+	if l.tail == nil {
+		l.head = w
+	} else {
+		l.tail.next = w
+	}
+	l.tail = w
+	w.listed = true
+	atomic.AddInt32(&l.count, 1)
+	return
+}
+
+// unlink a waiter; the lock must be held
+func (l *waitList[T]) unlink(w *waiter[T]) {
+	if w.prev == nil {
+		l.head = w.next
+	} else {
+		w.prev.next = w.next
+	}
+	if w.next == nil {
+		l.tail = w.prev
+	} else {
+		w.next.prev = w.prev
+	}
+	w.prev, w.next = nil, nil
+	w.listed = false
+	atomic.AddInt32(&l.count, -1)
+}
+
+// remove a waiter that gave up waiting.
+// If the waiter is already woken, then the token is consumed and ok is true with the handed value.
+// If no value is handed, then the wakeup is passed to another waiter.
+func (l *waitList[T]) cancel(w *waiter[T]) (v T, ok bool) {
+	l.mu.Lock()
+	if w.listed {
+		l.unlink(w)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+
+	// the token is sent while the lock is held, so it must be there
+	<-w.ch
+	if w.handed {
+		return w.take(), true
+	}
+	l.wakeOne()
+	return
+}
+
+// take the handed value out of a woken waiter
+func (w *waiter[T]) take() (v T) {
+	var zero T
+	v, w.value, w.handed = w.value, zero, false
+	return
+}
+
+// put a woken or cancelled waiter back to the free list
+func (l *waitList[T]) recycle(w *waiter[T]) {
+	l.mu.Lock()
+	l.recycleLocked(w)
+	l.mu.Unlock()
+}
+
+// recycle() with the lock held
+func (l *waitList[T]) recycleLocked(w *waiter[T]) {
+	w.next = l.free
+	l.free = w
+}
+
+// wake the first waiter in the list. Returns false if there is no waiter.
+func (l *waitList[T]) wakeOne() bool {
+	var zero T
+	return l.wake(zero, false)
+}
+
+func (l *waitList[T]) wake(v T, handed bool) bool {
+	if atomic.LoadInt32(&l.count) == 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.wakeLocked(v, handed)
+}
+
+// wake() with the lock held
+func (l *waitList[T]) wakeLocked(v T, handed bool) bool {
+	w := l.head
+	if w == nil {
+		return false
+	}
+	l.unlink(w)
+	w.value, w.handed = v, handed
+	w.ch <- struct{}{}
+	return true
+}